@@ -4,10 +4,13 @@ go 1.12
 
 require (
 	github.com/knative/pkg v0.0.0-20190330034653-916205998db9
+	github.com/prometheus/client_golang v0.9.4
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/sirupsen/logrus v1.4.2
 	github.com/tektoncd/pipeline v0.1.1-0.20190327171839-7c43fbae2816
 	k8s.io/api v0.0.0-20181128191700-6db15a15d2d3
 	k8s.io/apimachinery v0.0.0-20181128191346-49ce2735e507
 	k8s.io/client-go v9.0.0+incompatible
 	k8s.io/test-infra v0.0.0-20190628235729-eb4a109306ac
+	sigs.k8s.io/yaml v1.1.0
 )
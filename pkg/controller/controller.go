@@ -0,0 +1,2838 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	prowjobv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowjobset "k8s.io/test-infra/prow/client/clientset/versioned"
+	prowjobscheme "k8s.io/test-infra/prow/client/clientset/versioned/scheme"
+	prowjobinfov1 "k8s.io/test-infra/prow/client/informers/externalversions/prowjobs/v1"
+	prowjoblisters "k8s.io/test-infra/prow/client/listers/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+	"k8s.io/test-infra/prow/pjutil"
+	"k8s.io/test-infra/prow/pod-utils/decorate"
+	"k8s.io/test-infra/prow/pod-utils/downwardapi"
+	"k8s.io/test-infra/prow/pod-utils/gcs"
+
+	duckv1alpha1 "github.com/knative/pkg/apis/duck/v1alpha1"
+	"github.com/sirupsen/logrus"
+	pipelinev1alpha1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1alpha1"
+	pipelinelisters "github.com/tektoncd/pipeline/pkg/client/listers/pipeline/v1alpha1"
+	untypedcorev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinfov1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	controllerName = "prow-pipeline-crd"
+	jenkinsXAgent  = "jenkins-x"
+
+	// fallbackRevision is checked out when neither the refs nor --default-revision name a revision
+	fallbackRevision = "master"
+
+	// resyncBatchSize keys are enqueued every resyncBatchDelay, so a resync does not flood the queue
+	resyncBatchSize  = 100
+	resyncBatchDelay = time.Second
+
+	// throttleDelay is how long to wait before retrying a job held back by max_concurrency
+	throttleDelay = 10 * time.Second
+	// pauseDelay is how long to wait before retrying a job held back while the controller is paused
+	pauseDelay = 30 * time.Second
+	// waitJitter spreads out retries of keys that are waiting rather than failing
+	waitJitter = 0.2
+	// stallChecks is how many times a queue's depth is sampled within the stalled queue threshold
+	stallChecks = 5
+
+	// dryRunBuildID stands in for the build ids a dry run does not request from tot
+	dryRunBuildID = "dry-run"
+
+	// buildIDParamAnnotation names the param a job's pipeline expects the build id in
+	buildIDParamAnnotation = "prow.k8s.io/build-id-param"
+	// maxConcurrencyAnnotation records the job's max_concurrency on the objects we create
+	maxConcurrencyAnnotation = "prow.k8s.io/max-concurrency"
+	// resourceTypeAnnotation selects the type of pipeline resource a job checks out from, git by default
+	resourceTypeAnnotation = "prow.k8s.io/pipeline-resource-type"
+	// storageLocationAnnotation names the object or directory a storage resource checks out
+	storageLocationAnnotation = "prow.k8s.io/storage-location"
+	// jobNamespaceAnnotation picks the namespace a job's pipeline objects are created in, over any other setting
+	jobNamespaceAnnotation = "prow.k8s.io/pipeline-namespace"
+	// runNameAnnotation and runNamespaceAnnotation record where the prowjob's pipeline run was created
+	runNameAnnotation      = "prow.k8s.io/pipeline-run-name"
+	runNamespaceAnnotation = "prow.k8s.io/pipeline-run-namespace"
+	// runURLAnnotation records a link to the logs of a prowjob's pipeline run
+	runURLAnnotation = "prow.k8s.io/pipeline-run-url"
+	// specChecksumAnnotation records the checksum of the spec we generated for a run
+	specChecksumAnnotation = "prow.k8s.io/spec-checksum"
+	// specConfigMapAnnotation names the name/key of a ConfigMap in the prowjob namespace holding
+	// the PipelineRunSpec YAML of a job that does not embed one
+	specConfigMapAnnotation = "prow.k8s.io/pipeline-spec-configmap"
+	// tektonVersionAnnotation pins the Tekton API version a prowjob's pipeline uses
+	tektonVersionAnnotation = "prow.k8s.io/tekton-version"
+
+	// Reasons for the events recorded on prowjobs
+	reasonPipelineRunCreated      = "PipelineRunCreated"
+	reasonPipelineRunCreateFailed = "PipelineRunCreateFailed"
+	reasonResourceCreateFailed    = "PipelineResourceCreateFailed"
+	reasonServiceAccountFailed    = "ServiceAccountCreateFailed"
+	reasonProwJobErrored          = "ProwJobErrored"
+)
+
+// PreCreateHook adjusts a generated PipelineRun for its prowjob before it is created, such as to apply
+// an organization's policy. Returning an error moves the prowjob to error state instead of creating the run.
+// The prowjob is a copy, so changes to it are discarded.
+type PreCreateHook func(pj *prowjobv1.ProwJob, p *pipelinev1alpha1.PipelineRun) error
+
+// Option customizes the controller built by Main or NewReconciler.
+type Option func(*controller)
+
+// WithPreCreateHook applies hook to every PipelineRun before it is created,
+// such as in a custom build running controller.Main(controller.WithPreCreateHook(hook)).
+func WithPreCreateHook(hook PreCreateHook) Option {
+	return func(c *controller) {
+		c.preCreate = hook
+	}
+}
+
+// preCreateError means the pre-create hook rejected the run generated for a prowjob.
+type preCreateError struct {
+	err error
+}
+
+func (e preCreateError) Error() string {
+	return fmt.Sprintf("pre-create hook: %v", e.err)
+}
+
+type controller struct {
+	config    config.Getter
+	pjc       prowjobset.Interface
+	pipelines map[string]pipelineConfig
+	totURL    string
+	pauseFile string
+	// adminToken authorizes /admin/reconcile and /debug/config requests, which are refused without one
+	adminToken string
+
+	maxRetries      int
+	dryRun          bool
+	strictContexts  bool
+	summaryInterval time.Duration
+	resyncPeriod    time.Duration
+	orphanInterval  time.Duration
+	stuckThreshold  time.Duration
+	stallThreshold  time.Duration
+
+	// creates limits concurrent creates against the Tekton API, when set
+	creates chan struct{}
+	// preCreate adjusts runs before they are created, when set
+	preCreate PreCreateHook
+
+	pjLister   prowjoblisters.ProwJobLister
+	pjInformer cache.SharedIndexInformer
+	// cmLister resolves PipelineRunSpecs kept in ConfigMaps, when --spec-configmaps is set
+	cmLister   corelisters.ConfigMapLister
+	cmInformer cache.SharedIndexInformer
+
+	workqueue     workqueue.RateLimitingInterface
+	contextQueues map[string]workqueue.RateLimitingInterface
+
+	recorder record.EventRecorder
+
+	syncLock      sync.Mutex
+	prowJobsDone  bool
+	pipelinesDone map[string]bool
+	wait          string
+}
+
+type controllerOptions struct {
+	kc              kubernetes.Interface
+	pjc             prowjobset.Interface
+	pji             prowjobinfov1.ProwJobInformer
+	cmi             coreinfov1.ConfigMapInformer
+	pipelineConfigs map[string]pipelineConfig
+	totURL          string
+	pauseFile       string
+	adminToken      string
+	prowConfig      config.Getter
+	rl              workqueue.RateLimitingInterface
+	contextQueues   map[string]workqueue.RateLimitingInterface
+	maxRetries      int
+	dryRun          bool
+	strictContexts  bool
+	summaryInterval time.Duration
+	resyncPeriod    time.Duration
+	orphanInterval  time.Duration
+	stuckThreshold  time.Duration
+	stallThreshold  time.Duration
+	maxCreates      int
+}
+
+// pjNamespace retruns the prow namespace from configuration
+func (c *controller) pjNamespace() string {
+	return c.config().ProwJobNamespace
+}
+
+// hasSynced returns true when every prowjob and pipeline informer has synced.
+func (c *controller) hasSynced() bool {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+	if !c.pjInformer.HasSynced() {
+		if c.wait != "prowjobs" {
+			c.wait = "prowjobs"
+			ns := c.pjNamespace()
+			if ns == "" {
+				ns = "controllers"
+			}
+			logrus.Infof("Waiting on prowjobs in %s namespace...", ns)
+		}
+		return false // still syncing prowjobs
+	}
+	if !c.prowJobsDone {
+		c.prowJobsDone = true
+		logrus.Info("Synced prow jobs")
+	}
+	if c.cmInformer != nil && !c.cmInformer.HasSynced() {
+		if c.wait != "configmaps" {
+			c.wait = "configmaps"
+			logrus.Info("Waiting on configmaps...")
+		}
+		return false // still syncing the configmaps holding pipeline specs
+	}
+	if c.pipelinesDone == nil {
+		c.pipelinesDone = map[string]bool{}
+	}
+	for n, cfg := range c.pipelines {
+		if !cfg.informer.Informer().HasSynced() {
+			if c.wait != n {
+				c.wait = n
+				logrus.Infof("Waiting on %s pipelines...", n)
+			}
+			return false // still syncing pipelines in at least one cluster
+		} else if !c.pipelinesDone[n] {
+			c.pipelinesDone[n] = true
+			logrus.Infof("Synced %s pipelines", n)
+		}
+	}
+	return true // Everyone is synced
+}
+
+// healthz reports the process is alive.
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// readyz reports whether every informer has synced, naming the informer still syncing if not.
+func (c *controller) readyz(w http.ResponseWriter, _ *http.Request) {
+	if !c.hasSynced() {
+		c.syncLock.Lock()
+		wait := c.wait
+		c.syncLock.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "waiting on %s", wait)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// contextView is the resolved configuration of a context served by /debug/config.
+// It renders every PipelineOptions field, except for credentials.
+type contextView struct {
+	TotURL                string            `json:"totURL,omitempty"`
+	Namespace             string            `json:"namespace,omitempty"`
+	WatchNamespace        string            `json:"watchNamespace,omitempty"`
+	ServiceAccount        string            `json:"serviceAccount,omitempty"`
+	GCSServiceAccounts    bool              `json:"gcsServiceAccounts"`
+	DefaultRevision       string            `json:"defaultRevision,omitempty"`
+	GitHubHost            string            `json:"githubHost,omitempty"`
+	ProwBaseURL           string            `json:"prowBaseURL,omitempty"`
+	RunURLTemplate        string            `json:"runURLTemplate,omitempty"`
+	ParamPrefix           string            `json:"paramPrefix,omitempty"`
+	ParamsOnly            bool              `json:"paramsOnly"`
+	PreferSkipCloning     bool              `json:"preferSkipCloning"`
+	GenerateRunNames      bool              `json:"generateRunNames"`
+	KeepRunsOnAgentChange bool              `json:"keepRunsOnAgentChange"`
+	CancelSuperseded      bool              `json:"cancelSuperseded"`
+	SpecChecksum          bool              `json:"specChecksum"`
+	FixDrift              bool              `json:"fixDrift"`
+	MaxRunBytes           int               `json:"maxRunBytes,omitempty"`
+	MaxDescription        int               `json:"maxDescription"`
+	OwnerLabel            string            `json:"ownerLabel"`
+	RequiredLabels        []string          `json:"requiredLabels,omitempty"`
+	ExtraLabels           map[string]string `json:"extraLabels,omitempty"`
+	TektonAnnotations     map[string]string `json:"tektonAnnotations,omitempty"`
+	ReasonStates          map[string]string `json:"reasonStates,omitempty"`
+	JobTypes              []string          `json:"jobTypes,omitempty"`
+	JobNamespaces         []string          `json:"jobNamespaces,omitempty"`
+}
+
+// debugConfig serves the effective configuration of every context as JSON, without credentials.
+// It reveals the cluster's layout, so requests must carry the admin token as a bearer token.
+func (c *controller) debugConfig(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	view := struct {
+		DryRun         bool                   `json:"dryRun"`
+		StrictContexts bool                   `json:"strictContexts"`
+		Contexts       map[string]contextView `json:"contexts"`
+	}{
+		DryRun:         c.dryRun,
+		StrictContexts: c.strictContexts,
+		Contexts:       map[string]contextView{},
+	}
+	for ctx, cfg := range c.pipelines {
+		o := cfg.opts
+		ownerKey, ownerValue := o.ownerLabel()
+		v := contextView{
+			TotURL:                redactURL(c.totURLFor(ctx)),
+			Namespace:             o.namespace,
+			WatchNamespace:        o.watchNamespace,
+			ServiceAccount:        o.serviceAccount,
+			GCSServiceAccounts:    o.gcsServiceAccounts,
+			DefaultRevision:       o.defaultRevision,
+			GitHubHost:            o.githubHost,
+			ProwBaseURL:           redactURL(o.prowBaseURL),
+			ParamPrefix:           o.paramPrefix,
+			ParamsOnly:            o.paramsOnly,
+			PreferSkipCloning:     o.preferSkipCloning,
+			GenerateRunNames:      o.generateRunNames,
+			KeepRunsOnAgentChange: o.keepRunsOnAgentChange,
+			CancelSuperseded:      o.cancelSuperseded,
+			SpecChecksum:          o.specChecksum,
+			FixDrift:              o.fixDrift,
+			MaxRunBytes:           o.maxRunBytes,
+			MaxDescription:        o.descriptionLength(),
+			OwnerLabel:            ownerKey + "=" + ownerValue,
+			RequiredLabels:        o.requiredLabels,
+			ExtraLabels:           o.extraLabels,
+			TektonAnnotations:     o.tektonAnnotations,
+			JobNamespaces:         o.jobNamespaces,
+		}
+		if t := o.runURLTemplate; t != nil && t.Tree != nil {
+			v.RunURLTemplate = t.Tree.Root.String()
+		}
+		for reason, rs := range o.reasonStates {
+			if v.ReasonStates == nil {
+				v.ReasonStates = map[string]string{}
+			}
+			v.ReasonStates[reason] = string(rs.state)
+			if rs.description != "" {
+				v.ReasonStates[reason] += ":" + rs.description
+			}
+		}
+		for t := range o.jobTypes {
+			v.JobTypes = append(v.JobTypes, string(t))
+		}
+		sort.Strings(v.JobTypes)
+		view.Contexts[ctx] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		logrus.WithError(err).Warn("Failed to write /debug/config")
+	}
+}
+
+// adminReconcile enqueues the context/namespace/name key posted as the key form value for an immediate reconcile,
+// such as to unstick a job without waiting for a resync. Requests must carry the admin token as a bearer token.
+func (c *controller) adminReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a key to reconcile", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("key")
+	ctx, _, _, err := fromKey(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := c.pipelines[ctx]; !ok {
+		http.Error(w, fmt.Sprintf("unknown context %q", ctx), http.StatusNotFound)
+		return
+	}
+	logrus.WithField("key", key).Info("Reconcile requested by admin")
+	c.queueFor(ctx).Add(key)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "enqueued %s", key)
+}
+
+// authorized reports whether r carries the admin token as a bearer token, which no request does without one.
+func (c *controller) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return c.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.adminToken)) == 1
+}
+
+// redactURL removes any credentials from raw, returning nothing when it does not parse.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+func newController(opts controllerOptions) (*controller, error) {
+	// Otherwise prowjob gets and updates would target whatever the empty namespace means to the client
+	if opts.prowConfig == nil || opts.prowConfig() == nil {
+		return nil, errors.New("no prow config loaded, set --config")
+	}
+	if opts.prowConfig().ProwJobNamespace == "" {
+		return nil, errors.New("prow config does not set prowjob_namespace")
+	}
+	recorder, err := newRecorder(opts.kc)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &controller{
+		config:          opts.prowConfig,
+		pjc:             opts.pjc,
+		pipelines:       opts.pipelineConfigs,
+		pjLister:        opts.pji.Lister(),
+		pjInformer:      opts.pji.Informer(),
+		workqueue:       opts.rl,
+		contextQueues:   opts.contextQueues,
+		recorder:        recorder,
+		totURL:          opts.totURL,
+		pauseFile:       opts.pauseFile,
+		adminToken:      opts.adminToken,
+		maxRetries:      opts.maxRetries,
+		dryRun:          opts.dryRun,
+		strictContexts:  opts.strictContexts,
+		summaryInterval: opts.summaryInterval,
+		resyncPeriod:    opts.resyncPeriod,
+		orphanInterval:  opts.orphanInterval,
+		stuckThreshold:  opts.stuckThreshold,
+		stallThreshold:  opts.stallThreshold,
+	}
+	if opts.maxCreates > 0 {
+		c.creates = make(chan struct{}, opts.maxCreates)
+	}
+
+	logrus.Info("Setting up event handlers")
+
+	// Reconcile whenever a prowjob changes
+	opts.pji.Informer().AddEventHandler(c.prowJobHandler())
+
+	if opts.cmi != nil {
+		c.cmLister = opts.cmi.Lister()
+		c.cmInformer = opts.cmi.Informer()
+		// Reconcile the jobs taking their spec from a configmap whenever it changes
+		c.cmInformer.AddEventHandler(c.configMapHandler())
+	}
+
+	for ctx, cfg := range opts.pipelineConfigs {
+		// Reconcile whenever a pipelinerun changes.
+		cfg.informer.Informer().AddEventHandler(c.pipelineRunHandler(ctx))
+	}
+
+	return c, nil
+}
+
+// newRecorder returns a recorder that logs events and posts them through kc.
+func newRecorder(kc kubernetes.Interface) (record.EventRecorder, error) {
+	if err := prowjobscheme.AddToScheme(scheme.Scheme); err != nil {
+		return nil, err
+	}
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Infof)
+	eventBroadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: kc.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, untypedcorev1.EventSource{Component: controllerName}), nil
+}
+
+// prowJobHandler enqueues jenkins-x prowjobs whenever they change.
+// A job whose agent changes away from jenkins-x is delivered as a delete of its old version, so its runs are still cleaned up.
+func (c *controller) prowJobHandler() cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			pj, ok := unwrapTombstone(obj).(*prowjobv1.ProwJob)
+			return !ok || pj.Spec.Agent == jenkinsXAgent // let the handler report bad objects
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				pj, ok := obj.(*prowjobv1.ProwJob)
+				if !ok {
+					logrus.Warnf("Ignoring bad prowjob add: %v", obj)
+					return
+				}
+				c.enqueueKey(pjutil.ClusterToCtx(pj.Spec.Cluster), pj)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				pj, ok := new.(*prowjobv1.ProwJob)
+				if !ok {
+					logrus.Warnf("Ignoring bad prowjob update: %v", new)
+					return
+				}
+				c.enqueueKey(pjutil.ClusterToCtx(pj.Spec.Cluster), pj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				pj, ok := unwrapTombstone(obj).(*prowjobv1.ProwJob)
+				if !ok {
+					logrus.Warnf("Ignoring bad prowjob delete: %v", obj)
+					return
+				}
+				c.enqueueKey(pjutil.ClusterToCtx(pj.Spec.Cluster), pj)
+			},
+		},
+	}
+}
+
+// pipelineRunHandler enqueues pipeline runs in ctx whenever they change.
+func (c *controller) pipelineRunHandler(ctx string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueKey(ctx, obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueueKey(ctx, new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueKey(ctx, unwrapTombstone(obj))
+		},
+	}
+}
+
+// configMapHandler enqueues the unfinished prowjobs taking their spec from a configmap whenever its data changes,
+// such as to restore the new spec onto runs that have not started with --fix-spec-drift.
+func (c *controller) configMapHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			ocm, ook := old.(*untypedcorev1.ConfigMap)
+			ncm, nok := new.(*untypedcorev1.ConfigMap)
+			if !ook || !nok {
+				logrus.Warnf("Ignoring bad configmap update: %v", new)
+				return
+			}
+			if equality.Semantic.DeepEqual(ocm.Data, ncm.Data) {
+				return // a resync or a metadata change
+			}
+			c.enqueueSpecJobs(ncm.Name)
+		},
+	}
+}
+
+// enqueueSpecJobs enqueues the unfinished jenkins-x prowjobs whose spec is kept in the named configmap.
+func (c *controller) enqueueSpecJobs(name string) {
+	jobs, err := c.pjLister.ProwJobs(c.pjNamespace()).List(labels.Everything())
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to list prowjobs using configmap %s", name)
+		return
+	}
+	for _, pj := range jobs {
+		if pj.Spec.Agent != jenkinsXAgent || finalState(pj.Status.State) {
+			continue
+		}
+		if !strings.HasPrefix(pj.Annotations[specConfigMapAnnotation], name+"/") {
+			continue
+		}
+		c.enqueueKey(pjutil.ClusterToCtx(pj.Spec.Cluster), pj)
+	}
+}
+
+// unwrapTombstone returns the last known state of an object whose delete the informer missed.
+func unwrapTombstone(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// Run starts threads workers, returning after receiving a stop signal.
+func (c *controller) Run(threads int, stop <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	queues := c.queues()
+	for _, q := range queues {
+		defer q.ShutDown()
+	}
+
+	logrus.Info("Starting Pipeline controller")
+	logrus.Info("Waiting for informer caches to sync")
+	// Workers only start once every cache has synced, so no reconcile reads a partial cache
+	if ok := cache.WaitForCacheSync(stop, c.hasSynced); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	// Canceled on stop, so workers do not wait on create slots or retry updates past shutdown
+	goCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	logrus.Info("Starting workers")
+	for _, q := range queues {
+		q := q // otherwise it will change
+		for i := 0; i < threads; i++ {
+			go wait.Until(func() { c.runWorker(goCtx, q) }, time.Second, stop)
+		}
+	}
+
+	logrus.Info("Started workers")
+	if c.summaryInterval > 0 {
+		go wait.Until(c.logSummary, c.summaryInterval, stop)
+	}
+	if c.resyncPeriod > 0 {
+		go wait.JitterUntil(c.resync, c.resyncPeriod, waitJitter, true, stop) // avoid lining up with informer relists
+	}
+	if c.orphanInterval > 0 {
+		go wait.Until(c.deleteOrphans, c.orphanInterval, stop)
+	}
+	if c.stuckThreshold > 0 {
+		go wait.Until(c.requeueStuck, c.stuckThreshold, stop)
+	}
+	if c.stallThreshold > 0 {
+		for name, q := range c.namedQueues() {
+			w := &queueWatchdog{name: name, queue: q, checks: stallChecks}
+			go wait.Until(w.check, c.stallThreshold/stallChecks, stop)
+		}
+	}
+	<-stop
+	logrus.Info("Shutting down workers")
+	return nil
+}
+
+// runWorker dequeues from queue to reconcile, until the queue has closed.
+func (c *controller) runWorker(goCtx context.Context, queue workqueue.RateLimitingInterface) {
+	for {
+		key, shutdown := queue.Get()
+		if shutdown {
+			return
+		}
+		func() {
+			defer queue.Done(key)
+			processKey(goCtx, c, queue, key.(string), c.maxRetries)
+		}()
+	}
+}
+
+// queueFor returns the queue for keys in ctx, so a failing cluster only backs up its own reconciles.
+func (c *controller) queueFor(ctx string) workqueue.RateLimitingInterface {
+	if q, ok := c.contextQueues[ctx]; ok {
+		return q
+	}
+	return c.workqueue
+}
+
+// queues returns the default queue followed by each context's queue.
+func (c *controller) queues() []workqueue.RateLimitingInterface {
+	queues := []workqueue.RateLimitingInterface{c.workqueue}
+	for _, ctx := range sets.StringKeySet(c.contextQueues).List() { // deterministic ordering
+		queues = append(queues, c.contextQueues[ctx])
+	}
+	return queues
+}
+
+// namedQueues returns every queue by the name its metrics are labeled with.
+func (c *controller) namedQueues() map[string]workqueue.RateLimitingInterface {
+	queues := map[string]workqueue.RateLimitingInterface{controllerName: c.workqueue}
+	for ctx, q := range c.contextQueues {
+		queues[controllerName+"-"+ctx] = q
+	}
+	return queues
+}
+
+// queueWatchdog notices a queue whose workers have stopped draining it, such as when they are deadlocked,
+// since keys keep arriving but nothing fails.
+type queueWatchdog struct {
+	name  string
+	queue interface {
+		Len() int
+	}
+	// checks is how many consecutive checks the depth must grow at before the queue counts as stalled
+	checks int
+
+	depth   int
+	growing int
+	stalled bool
+}
+
+// check samples the queue's depth, warning when it has grown at each of the last checks.
+func (w *queueWatchdog) check() {
+	depth := w.queue.Len()
+	if depth > w.depth {
+		w.growing++
+	} else {
+		w.growing = 0
+	}
+	w.depth = depth
+	stalled := w.growing >= w.checks
+	if stalled {
+		logrus.WithField("queue", w.name).Warnf("Queue depth grew for %d checks in a row to %d, workers may be stuck", w.growing, depth)
+	} else if w.stalled {
+		logrus.WithField("queue", w.name).Infof("Queue is draining again at depth %d", depth)
+	}
+	w.stalled = stalled
+	v := 0.0
+	if stalled {
+		v = 1
+	}
+	queueStalled.WithLabelValues(w.name).Set(v)
+}
+
+// resync requeues every jenkins-x prowjob, recovering jobs whose events were missed.
+func (c *controller) resync() {
+	selector := labels.SelectorFromSet(labels.Set{kube.CreatedByProw: "true"})
+	pjs, err := c.pjLister.ProwJobs(c.pjNamespace()).List(selector)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to list prowjobs to resync")
+		return
+	}
+	var n int
+	for _, pj := range pjs {
+		if pj.Spec.Agent != jenkinsXAgent {
+			continue
+		}
+		ns := pj.Spec.Namespace
+		if ns == "" {
+			ns = pj.Namespace
+		}
+		ctx := pjutil.ClusterToCtx(pj.Spec.Cluster)
+		key := toKey(ctx, ns, pj.Name)
+		c.queueFor(ctx).AddAfter(key, resyncDelay(n))
+		n++
+	}
+	logrus.Debugf("Resynced %d prowjobs", n)
+}
+
+// resyncDelay picks a random delay within the batch window of the nth resynced key,
+// so even a single batch trickles into the queue rather than arriving at once.
+func resyncDelay(n int) time.Duration {
+	batch := time.Duration(n/resyncBatchSize) * resyncBatchDelay
+	return batch + time.Duration(rand.Int63n(int64(resyncBatchDelay)))
+}
+
+// requeueStuck requeues jenkins-x prowjobs triggered longer than the stuck threshold ago that have no pipeline run,
+// so a run whose creation never persisted is created again.
+func (c *controller) requeueStuck() {
+	selector := labels.SelectorFromSet(labels.Set{kube.CreatedByProw: "true"})
+	pjs, err := c.pjLister.ProwJobs(c.pjNamespace()).List(selector)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to list prowjobs to check for stuck jobs")
+		return
+	}
+	now := c.Now()
+	for _, pj := range pjs {
+		if pj.Spec.Agent != jenkinsXAgent || pj.Status.State != prowjobv1.TriggeredState {
+			continue
+		}
+		if now.Sub(pj.Status.StartTime.Time) < c.stuckThreshold {
+			continue
+		}
+		ns := pj.Spec.Namespace
+		if ns == "" {
+			ns = pj.Namespace
+		}
+		ctx := pjutil.ClusterToCtx(pj.Spec.Cluster)
+		key := toKey(ctx, ns, pj.Name)
+		opts, err := c.GetPipelineOptions(ctx)
+		if err != nil {
+			continue // reconcile handles unknown contexts
+		}
+		runNamespace := jobPipelineNamespace(*pj, opts, ns)
+		if n := pj.Annotations[runNamespaceAnnotation]; n != "" {
+			runNamespace = n
+		}
+		switch _, err := c.FindPipelineRun(ctx, runNamespace, pj.Name); {
+		case err == nil:
+			continue
+		case !apierrors.IsNotFound(err):
+			logrus.WithError(err).Warnf("Failed to find PipelineRun for stuck check of %s", key)
+			continue
+		}
+		logrus.Warnf("Requeue %s: triggered since %s with no PipelineRun", key, pj.Status.StartTime)
+		c.queueFor(ctx).Add(key)
+	}
+}
+
+// deleteOrphans deletes finished prow pipeline runs whose prowjob no longer exists.
+func (c *controller) deleteOrphans() {
+	if c.Paused() {
+		logrus.Warn("Paused: skipping orphaned pipeline run cleanup")
+		return
+	}
+	for _, ctx := range sets.StringKeySet(c.pipelines).List() { // deterministic ordering
+		runs, err := c.pipelines[ctx].informer.Lister().List(c.pipelines[ctx].opts.ownerSelector())
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to list %s pipeline runs", ctx)
+			continue
+		}
+		for _, r := range runs {
+			if r.DeletionTimestamp != nil || !finishedPipelineRun(r.Status) {
+				continue
+			}
+			name := r.Labels[kube.ProwJobIDLabel]
+			if name == "" {
+				name = r.Name
+			}
+			switch _, err := c.GetProwJob(name); {
+			case err == nil:
+				continue
+			case !apierrors.IsNotFound(err):
+				logrus.WithError(err).Warnf("Failed to get prowjob for PipelineRun/%s", toKey(ctx, r.Namespace, r.Name))
+				continue
+			}
+			logrus.Infof("Delete orphaned PipelineRun/%s", toKey(ctx, r.Namespace, r.Name))
+			if err := c.DeletePipelineRun(ctx, r.Namespace, r.Name); err != nil && !apierrors.IsNotFound(err) {
+				logrus.WithError(err).Warnf("Failed to delete orphaned PipelineRun/%s", toKey(ctx, r.Namespace, r.Name))
+			}
+		}
+	}
+}
+
+// logSummary logs how many prow pipeline runs each context has in each state.
+func (c *controller) logSummary() {
+	synced := c.hasSynced()
+	for _, ctx := range sets.StringKeySet(c.pipelines).List() { // deterministic ordering
+		fields := logrus.Fields{
+			"context": ctx,
+			"synced":  synced,
+		}
+		counts, err := summarizePipelineRuns(c.pipelines[ctx].informer.Lister(), c.pipelines[ctx].opts)
+		if err != nil {
+			logrus.WithError(err).WithFields(fields).Warn("Failed to summarize pipeline runs")
+			continue
+		}
+		var total int
+		for state, n := range counts {
+			fields[string(state)] = n
+			total += n
+		}
+		fields["total"] = total
+		logrus.WithFields(fields).Info("Pipeline run summary")
+	}
+}
+
+// summarizePipelineRuns counts the pipeline runs this controller owns by the prowjob state their status maps to.
+func summarizePipelineRuns(lister pipelinelisters.PipelineRunLister, opts PipelineOptions) (map[prowjobv1.ProwJobState]int, error) {
+	runs, err := lister.List(opts.ownerSelector())
+	if err != nil {
+		return nil, err
+	}
+	counts := map[prowjobv1.ProwJobState]int{}
+	for _, r := range runs {
+		state, _ := prowJobStatus(r.Status, opts.reasonStates)
+		counts[state]++
+	}
+	return counts, nil
+}
+
+// processKey reconciles key, requeuing with backoff on failure until maxRetries is reached.
+func processKey(goCtx context.Context, c reconciler, queue workqueue.RateLimitingInterface, key string, maxRetries int) {
+	err := reconcile(goCtx, c, key)
+	if err == nil {
+		queue.Forget(key)
+		return
+	}
+	retries := queue.NumRequeues(key)
+	if maxRetries <= 0 || retries < maxRetries {
+		runtime.HandleError(fmt.Errorf("failed to reconcile %s: %v", key, err))
+		queue.AddRateLimited(key)
+		return
+	}
+	logrus.WithError(err).Warnf("Giving up on %s after %d retries", key, retries)
+	msg := fmt.Sprintf("giving up after %d retries: %v", retries, err)
+	if err := failProwJob(goCtx, c, key, msg); err != nil {
+		logrus.WithError(err).Errorf("Failed to move %s to error state, leaving it unfinished", key)
+		retriesExhausted.WithLabelValues(exhaustedUpdateFailed).Inc()
+	} else {
+		retriesExhausted.WithLabelValues(exhaustedErrored).Inc()
+	}
+	queue.Forget(key)
+}
+
+// failProwJob moves the prowjob for key to error state, unless it already finished.
+func failProwJob(goCtx context.Context, c reconciler, key, msg string) error {
+	ctx, namespace, name, err := fromKey(key)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"context":   ctx,
+		"namespace": namespace,
+		"name":      name,
+	})
+	pj, err := c.GetProwJob(name)
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("get prowjob: %v", err)
+	case finalState(pj.Status.State):
+		return nil
+	}
+	return updateProwJobState(goCtx, c, log.WithField("job", pj.Spec.Job), key, false, pj, prowjobv1.ErrorState, msg)
+}
+
+// toKey returns context/namespace/name
+func toKey(ctx, namespace, name string) string {
+	return strings.Join([]string{ctx, namespace, name}, "/")
+}
+
+// keyPartsError means a key does not split into the context, namespace and name parts toKey joins.
+type keyPartsError struct {
+	key   string
+	parts int
+}
+
+func (e keyPartsError) Error() string {
+	return fmt.Sprintf("bad key %q: %d parts, expected context/namespace/name", e.key, e.parts)
+}
+
+// emptyKeyPartError means a key has the right shape but no context or name.
+type emptyKeyPartError struct {
+	key  string
+	part string
+}
+
+func (e emptyKeyPartError) Error() string {
+	return fmt.Sprintf("bad key %q: empty %s", e.key, e.part)
+}
+
+// fromKey converts toKey back into its parts
+// The namespace may be empty, since prowjobs need not set one.
+func fromKey(key string) (string, string, string, error) {
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) != 3:
+		return "", "", "", keyPartsError{key: key, parts: len(parts)}
+	case parts[0] == "":
+		return "", "", "", emptyKeyPartError{key: key, part: "context"}
+	case parts[2] == "":
+		return "", "", "", emptyKeyPartError{key: key, part: "name"}
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// enqueueKey schedules an item for reconciliation.
+// Events skip the rate limiter, which only counts failed reconciles towards --max-retries.
+func (c *controller) enqueueKey(ctx string, obj interface{}) {
+	switch o := obj.(type) {
+	case *prowjobv1.ProwJob:
+		ns := o.Spec.Namespace
+		if ns == "" {
+			ns = o.Namespace
+		}
+		c.queueFor(ctx).Add(toKey(ctx, ns, o.Name))
+	case *pipelinev1alpha1.PipelineRun:
+		name := o.Name
+		if job := o.Labels[kube.ProwJobIDLabel]; job != "" {
+			// Runs with generated names are reconciled under their prowjob's name
+			name = job
+		}
+		c.queueFor(ctx).Add(toKey(ctx, o.Namespace, name))
+	default:
+		logrus.Warnf("cannot enqueue unknown type %T: %v", o, obj)
+		return
+	}
+}
+
+// reconciler is what reconcile reads and changes prowjobs and pipeline runs through.
+// The controller implements it with informer listers and clientsets.
+// Creates take a context.Context bounding their wait for a create slot; the vendored clientsets
+// take none, so in-flight requests are bounded by --api-timeout instead.
+type reconciler interface {
+	GetProwJob(name string) (*prowjobv1.ProwJob, error)
+	FetchProwJob(name string) (*prowjobv1.ProwJob, error)
+	GetConfigMap(name string) (*untypedcorev1.ConfigMap, error)
+	UpdateProwJob(pj *prowjobv1.ProwJob) (*prowjobv1.ProwJob, error)
+	GetPipelineRun(context, namespace, name string) (*pipelinev1alpha1.PipelineRun, error)
+	FetchPipelineRun(context, namespace, name string) (*pipelinev1alpha1.PipelineRun, error)
+	FindPipelineRun(context, namespace, job string) (*pipelinev1alpha1.PipelineRun, error)
+	CountActivePipelineRuns(context, job string) (int, error)
+	ListPipelineRuns(context, job string) ([]pipelinev1alpha1.PipelineRun, error)
+	DeletePipelineRun(context, namespace, name string) error
+	UpdatePipelineRun(context, namespace string, p *pipelinev1alpha1.PipelineRun) (*pipelinev1alpha1.PipelineRun, error)
+	CreatePipelineRun(goCtx context.Context, context, namespace string, b *pipelinev1alpha1.PipelineRun) (*pipelinev1alpha1.PipelineRun, error)
+	CreatePipelineResource(goCtx context.Context, context, namespace string, b *pipelinev1alpha1.PipelineResource) (*pipelinev1alpha1.PipelineResource, error)
+	CreateServiceAccount(context, namespace string, sa *untypedcorev1.ServiceAccount) (*untypedcorev1.ServiceAccount, error)
+	PipelineID(prowjobv1.ProwJob) (string, string, error)
+	GetPipelineOptions(context string) (PipelineOptions, error)
+	RequeueAfter(key string, delay time.Duration)
+	Paused() bool
+	MutatePipelineRun(pj *prowjobv1.ProwJob, p *pipelinev1alpha1.PipelineRun) error
+	RecordEvent(pj *prowjobv1.ProwJob, eventtype, reason, message string)
+	Now() metav1.Time
+}
+
+// unknownContextError means a prowjob targets a context with no cluster configuration.
+type unknownContextError struct {
+	context string
+}
+
+func (e unknownContextError) Error() string {
+	return fmt.Sprintf("no cluster configuration found for context %q", e.context)
+}
+
+func (c *controller) getPipelineConfig(ctx string) (pipelineConfig, error) {
+	cfg, ok := c.pipelines[ctx]
+	if !ok {
+		if c.strictContexts {
+			return pipelineConfig{}, unknownContextError{context: ctx}
+		}
+		defaultCtx := kube.DefaultClusterAlias
+		defaultCfg, ok := c.pipelines[defaultCtx]
+		if !ok {
+			return pipelineConfig{}, fmt.Errorf("no cluster configuration found for default context %q", defaultCtx)
+		}
+		return defaultCfg, nil
+	}
+	return cfg, nil
+}
+
+func (c *controller) GetPipelineOptions(ctx string) (PipelineOptions, error) {
+	p, err := c.getPipelineConfig(ctx)
+	if err != nil {
+		return PipelineOptions{}, err
+	}
+	return p.opts, nil
+}
+
+func (c *controller) GetProwJob(name string) (*prowjobv1.ProwJob, error) {
+	return c.pjLister.ProwJobs(c.pjNamespace()).Get(name)
+}
+
+// FetchProwJob gets a prowjob from the API server, for when the lister may be behind.
+func (c *controller) FetchProwJob(name string) (*prowjobv1.ProwJob, error) {
+	return c.pjc.ProwV1().ProwJobs(c.pjNamespace()).Get(name, metav1.GetOptions{})
+}
+
+// GetConfigMap returns the named ConfigMap in the prowjob namespace.
+func (c *controller) GetConfigMap(name string) (*untypedcorev1.ConfigMap, error) {
+	if c.cmLister == nil {
+		return nil, errors.New("configmaps are not watched, set --spec-configmaps")
+	}
+	return c.cmLister.ConfigMaps(c.pjNamespace()).Get(name)
+}
+
+func (c *controller) UpdateProwJob(pj *prowjobv1.ProwJob) (*prowjobv1.ProwJob, error) {
+	logrus.Debugf("updateProwJob(%s)", pj.Name)
+	if c.dryRun {
+		logDryRun("update ProwJob", pj)
+		return pj, nil
+	}
+	return c.pjc.ProwV1().ProwJobs(c.pjNamespace()).Update(pj)
+}
+
+func (c *controller) GetPipelineRun(context, namespace, name string) (*pipelinev1alpha1.PipelineRun, error) {
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	return p.informer.Lister().PipelineRuns(namespace).Get(name)
+}
+
+// FetchPipelineRun gets a pipeline run from the API server, for runs the informer may not have seen yet.
+func (c *controller) FetchPipelineRun(context, namespace, name string) (*pipelinev1alpha1.PipelineRun, error) {
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.TektonV1alpha1().PipelineRuns(namespace).Get(name, metav1.GetOptions{})
+}
+
+// FindPipelineRun returns the newest prow pipeline run in namespace created for the prowjob named job.
+func (c *controller) FindPipelineRun(context, namespace, job string) (*pipelinev1alpha1.PipelineRun, error) {
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	key, value := p.opts.ownerLabel()
+	selector := labels.SelectorFromSet(labels.Set{
+		key:                 value,
+		kube.ProwJobIDLabel: job,
+	})
+	runs, err := p.informer.Lister().PipelineRuns(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	var newest *pipelinev1alpha1.PipelineRun
+	for _, r := range runs {
+		if newest == nil || newest.CreationTimestamp.Before(&r.CreationTimestamp) {
+			newest = r
+		}
+	}
+	if newest == nil {
+		return nil, apierrors.NewNotFound(pipelinev1alpha1.Resource("PipelineRun"), job)
+	}
+	return newest, nil
+}
+
+// CountActivePipelineRuns returns the number of unfinished prow pipeline runs for job in context.
+func (c *controller) CountActivePipelineRuns(context, job string) (int, error) {
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return 0, err
+	}
+	key, value := p.opts.ownerLabel()
+	selector := labels.SelectorFromSet(labels.Set{
+		key:                    value,
+		kube.ProwJobAnnotation: job,
+	})
+	runs, err := p.informer.Lister().List(selector)
+	if err != nil {
+		return 0, err
+	}
+	var active int
+	for _, r := range runs {
+		if r.DeletionTimestamp == nil && !finishedPipelineRun(r.Status) {
+			active++
+		}
+	}
+	return active, nil
+}
+
+// ListPipelineRuns returns the prow pipeline runs for job in context.
+func (c *controller) ListPipelineRuns(context, job string) ([]pipelinev1alpha1.PipelineRun, error) {
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	key, value := p.opts.ownerLabel()
+	selector := labels.SelectorFromSet(labels.Set{
+		key:                    value,
+		kube.ProwJobAnnotation: job,
+	})
+	runs, err := p.informer.Lister().List(selector)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]pipelinev1alpha1.PipelineRun, 0, len(runs))
+	for _, r := range runs {
+		out = append(out, *r.DeepCopy()) // never modify the informer's cache
+	}
+	return out, nil
+}
+
+func (c *controller) DeletePipelineRun(context, namespace, name string) error {
+	logrus.Debugf("deletePipeline(%s,%s,%s)", context, namespace, name)
+	p, err := c.getPipelineConfig(context)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		logDryRun("delete PipelineRun", toKey(context, namespace, name))
+		return nil
+	}
+	return p.client.TektonV1alpha1().PipelineRuns(namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+func (c *controller) UpdatePipelineRun(context, namespace string, p *pipelinev1alpha1.PipelineRun) (*pipelinev1alpha1.PipelineRun, error) {
+	logrus.Debugf("updatePipelineRun(%s,%s,%s)", context, namespace, p.Name)
+	pc, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryRun {
+		logDryRun("update PipelineRun", p)
+		return p, nil
+	}
+	return pc.client.TektonV1alpha1().PipelineRuns(namespace).Update(p)
+}
+
+func (c *controller) CreatePipelineRun(goCtx context.Context, context, namespace string, p *pipelinev1alpha1.PipelineRun) (*pipelinev1alpha1.PipelineRun, error) {
+	logrus.Debugf("createPipelineRun(%s,%s,%s)", context, namespace, p.Name)
+	pc, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryRun {
+		logDryRun("create PipelineRun", p)
+		return p, nil
+	}
+	release, err := c.acquireCreate(goCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return pc.client.TektonV1alpha1().PipelineRuns(namespace).Create(p)
+}
+
+func (c *controller) CreatePipelineResource(goCtx context.Context, context, namespace string, pr *pipelinev1alpha1.PipelineResource) (*pipelinev1alpha1.PipelineResource, error) {
+	logrus.Debugf("createPipelineResource(%s,%s,%s)", context, namespace, pr.Name)
+	pc, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryRun {
+		logDryRun("create PipelineResource", pr)
+		return pr, nil
+	}
+	release, err := c.acquireCreate(goCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return pc.client.TektonV1alpha1().PipelineResources(namespace).Create(pr)
+}
+
+// acquireCreate waits for a free create slot until goCtx is done, returning a func that frees it.
+// Without a limit it returns immediately.
+func (c *controller) acquireCreate(goCtx context.Context) (func(), error) {
+	if c.creates == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.creates <- struct{}{}:
+		return func() { <-c.creates }, nil
+	case <-goCtx.Done():
+		return nil, fmt.Errorf("wait for a create slot: %v", goCtx.Err())
+	}
+}
+
+// RecordEvent records an event on the prowjob, so it shows up in kubectl describe.
+func (c *controller) RecordEvent(pj *prowjobv1.ProwJob, eventtype, reason, message string) {
+	if c.dryRun {
+		logDryRun("record Event", untypedcorev1.Event{Type: eventtype, Reason: reason, Message: message})
+		return
+	}
+	c.recorder.Event(pj, eventtype, reason, message)
+}
+
+// CreateServiceAccount creates sa in the namespace of the context's cluster.
+func (c *controller) CreateServiceAccount(context, namespace string, sa *untypedcorev1.ServiceAccount) (*untypedcorev1.ServiceAccount, error) {
+	logrus.Debugf("createServiceAccount(%s,%s,%s)", context, namespace, sa.Name)
+	pc, err := c.getPipelineConfig(context)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryRun {
+		logDryRun("create ServiceAccount", sa)
+		return sa, nil
+	}
+	return pc.kc.CoreV1().ServiceAccounts(namespace).Create(sa)
+}
+
+// logDryRun logs the object a mutating call would have sent.
+func logDryRun(action string, obj interface{}) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		logrus.WithError(err).Warnf("Dry run: %s: failed to marshal %T", action, obj)
+		return
+	}
+	logrus.Infof("Dry run: %s: %s", action, b)
+}
+
+// RequeueAfter retries a key that is waiting rather than failing after about delay, without adding to its error backoff.
+func (c *controller) RequeueAfter(key string, delay time.Duration) {
+	ctx, _, _, _ := fromKey(key) // a bad key goes to the default queue
+	c.queueFor(ctx).AddAfter(key, wait.Jitter(delay, waitJitter))
+}
+
+// Paused returns true while the pause file exists, so operators can stop pipeline run mutations without a restart.
+func (c *controller) Paused() bool {
+	if c.pauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(c.pauseFile)
+	return err == nil
+}
+
+// MutatePipelineRun applies the pre-create hook to p, when there is one.
+func (c *controller) MutatePipelineRun(pj *prowjobv1.ProwJob, p *pipelinev1alpha1.PipelineRun) error {
+	if c.preCreate == nil {
+		return nil
+	}
+	return c.preCreate(pj, p)
+}
+
+func (c *controller) Now() metav1.Time {
+	return metav1.Now()
+}
+
+// totURLFor returns the tot that vends build IDs for ctx, falling back to the global one.
+func (c *controller) totURLFor(ctx string) string {
+	if cfg, err := c.getPipelineConfig(ctx); err == nil && cfg.totURL != "" {
+		return cfg.totURL
+	}
+	return c.totURL
+}
+
+func (c *controller) PipelineID(pj prowjobv1.ProwJob) (string, string, error) {
+	id := dryRunBuildID
+	if !c.dryRun { // tot vends each build id once, so a dry run must not use any up
+		var err error
+		if id, err = pjutil.GetBuildID(pj.Spec.Job, c.totURLFor(pjutil.ClusterToCtx(pj.Spec.Cluster))); err != nil {
+			return "", "", err
+		}
+	}
+	pj.Status.BuildID = id
+	url := pjutil.JobURL(c.config().Plank, pj, logrus.NewEntry(logrus.StandardLogger()))
+	return id, url, nil
+}
+
+// reconcile ensures a tekton prowjob has a corresponding pipeline, updating the prowjob's status as the pipeline progresses.
+// The key is context/namespace/name, where name is the prowjob's. A returned error means the key should be retried.
+func reconcile(goCtx context.Context, c reconciler, key string) (err error) {
+	ctx, namespace, name, err := fromKey(key)
+	if err != nil {
+		// Retrying cannot fix the key, but whatever enqueued it is broken
+		logrus.WithError(err).WithField("key", key).Error("Dropping malformed key")
+		return nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"context":   ctx,
+		"namespace": namespace,
+		"name":      name,
+	})
+	log.Debugf("reconcile: %s", key)
+
+	var wantPipelineRun, havePipelineRun bool
+	var beforeState, afterState prowjobv1.ProwJobState
+	defer func() {
+		fields := logrus.Fields{
+			"key":             key,
+			"wantPipelineRun": wantPipelineRun,
+			"havePipelineRun": havePipelineRun,
+			"beforeState":     beforeState,
+			"afterState":      afterState,
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		log.WithFields(fields).Debug("Reconciled")
+	}()
+
+	opts, err := c.GetPipelineOptions(ctx)
+	if _, ok := err.(unknownContextError); ok {
+		return rejectUnknownContext(goCtx, c, log, key, name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("get pipeline options: %v", err)
+	}
+	namespace = opts.pipelineNamespace(namespace)
+	log = log.WithField("namespace", namespace)
+
+	var agentChanged bool
+	pj, err := c.GetProwJob(name)
+	switch {
+	case apierrors.IsNotFound(err):
+		// Do not want pipeline
+	case err != nil:
+		return fmt.Errorf("get prowjob: %v", err)
+	case pj.Spec.Agent != jenkinsXAgent:
+		// Do not want a pipeline for this job
+		agentChanged = true
+	case !opts.managesJobType(pj.Spec.Type):
+		// Leave this job and any pipeline it already has alone
+		log.Debugf("Ignore %s: %s jobs are not managed", key, pj.Spec.Type)
+		return nil
+	case pjutil.ClusterToCtx(pj.Spec.Cluster) != ctx:
+		// Build is in wrong cluster, we do not want this build
+		log.Warnf("%s found in context %s not %s", key, ctx, pjutil.ClusterToCtx(pj.Spec.Cluster))
+	case pj.DeletionTimestamp == nil:
+		wantPipelineRun = true
+	}
+	runName := name
+	if pj != nil {
+		log = log.WithField("job", pj.Spec.Job)
+		beforeState = pj.Status.State
+		afterState = beforeState
+		if ns := pj.Annotations[jobNamespaceAnnotation]; ns != "" && ns != namespace {
+			namespace = ns
+			log = log.WithField("namespace", namespace)
+		}
+		// Find the run where we created it, rather than assuming it matches the prowjob
+		if n := pj.Annotations[runNameAnnotation]; n != "" {
+			runName = n
+		}
+		if ns := pj.Annotations[runNamespaceAnnotation]; ns != "" && ns != namespace {
+			namespace = ns
+			log = log.WithField("namespace", namespace)
+		}
+	}
+	if !opts.watches(namespace) {
+		// We would never see the run's status, so neither create nor delete it
+		if wantPipelineRun && !finalState(pj.Status.State) {
+			msg := fmt.Sprintf("pipeline namespace %s is not watched", namespace)
+			log.Warnf("Reject %s: %s", key, msg)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.ErrorState, msg)
+		}
+		log.Debugf("Ignore %s: namespace %s is not watched", key, namespace)
+		return nil
+	}
+
+	p, err := c.GetPipelineRun(ctx, namespace, runName)
+	if apierrors.IsNotFound(err) {
+		// The run's name need not match the job's, such as a generated name the prowjob has not recorded yet
+		p, err = c.FindPipelineRun(ctx, namespace, name)
+	}
+	if apierrors.IsNotFound(err) && runName != name && wantPipelineRun && !finalState(pj.Status.State) {
+		// We recorded creating this run, so the informer has likely not seen it yet.
+		// Ask the API server rather than create a second run under another generated name.
+		p, err = c.FetchPipelineRun(ctx, namespace, runName)
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		// Do not have a pipeline
+	case err != nil:
+		return fmt.Errorf("get pipelinerun %s: %v", key, err)
+	case p.DeletionTimestamp == nil:
+		havePipelineRun = true
+	}
+
+	// Resolve a spec kept in a ConfigMap without writing it back, so the prowjob stays small
+	var spec *pipelinev1alpha1.PipelineRunSpec
+	var specRef string
+	if pj != nil {
+		spec = pj.Spec.PipelineRunSpec
+		specRef = pj.Annotations[specConfigMapAnnotation]
+	}
+	if wantPipelineRun && spec == nil && specRef != "" && !finalState(pj.Status.State) {
+		switch spec, err = configMapPipelineRunSpec(c, specRef); {
+		case err == nil:
+		case havePipelineRun:
+			// The run no longer needs its spec, so keep its status in sync
+			log.WithError(err).Warnf("Failed to resolve the PipelineRunSpec of %s", key)
+		case transientError(err):
+			return fmt.Errorf("resolve PipelineRunSpec of %s: %v", key, err)
+		default:
+			msg := fmt.Sprintf("pipeline spec configmap: %v", err)
+			log.Warnf("Reject %s: %s", key, msg)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.ErrorState, msg)
+		}
+	}
+
+	var newPipelineRun bool
+	switch {
+	case !wantPipelineRun:
+		if !havePipelineRun {
+			if pj != nil && pj.Spec.Agent == jenkinsXAgent {
+				log.Infof("Observed deleted: %s", key)
+			}
+			return nil
+		}
+
+		// Skip deleting if the pipeline run is not created by this controller
+		if !opts.owns(*p) {
+			return nil
+		}
+		if agentChanged && opts.keepRunsOnAgentChange {
+			log.Infof("Keep PipelineRun/%s: prowjob agent changed to %s", key, pj.Spec.Agent)
+			return nil
+		}
+		if c.Paused() {
+			log.Warnf("Paused: not deleting PipelineRun/%s", key)
+			return nil
+		}
+		log.Infof("Delete PipelineRun/%s", key)
+		if err = c.DeletePipelineRun(ctx, namespace, p.Name); err != nil {
+			return fmt.Errorf("delete pipelinerun: %v", err)
+		}
+		return nil
+	case finalState(pj.Status.State):
+		// Never let a stale or regressed pipeline status un-finish the job
+		log.Infof("Observed finished: %s", key)
+		return nil
+	case wantPipelineRun && spec == nil && (!havePipelineRun || specRef == ""):
+		return fmt.Errorf("nil PipelineRunSpec in ProwJob/%s", key)
+	case wantPipelineRun && !havePipelineRun && pj.Status.State == prowjobv1.PendingState:
+		// Only a started run makes a job pending, so someone deleted it mid-run or it was garbage collected
+		// before we saw it finish. Either way recreating it would silently rerun the job.
+		// A triggered job's run may never have persisted, so that one is created again below.
+		log.Warnf("Abort %s: its PipelineRun/%s is gone", key, runName)
+		afterState = prowjobv1.AbortedState
+		return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.AbortedState, descRunDeleted)
+	case wantPipelineRun && !havePipelineRun && c.Paused():
+		log.Warnf("Paused: not creating PipelineRun/%s", key)
+		c.RequeueAfter(key, pauseDelay)
+		return nil
+	case wantPipelineRun && !havePipelineRun:
+		for _, validate := range []func(prowjobv1.ProwJob) error{validateTektonVersion, validateResourceType, opts.validateJobNamespace} {
+			if err := validate(*pj); err != nil {
+				log.Warnf("Reject %s: %v", key, err)
+				afterState = prowjobv1.ErrorState
+				return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.ErrorState, err.Error())
+			}
+		}
+		if missing := missingLabels(*pj, opts.requiredLabels); len(missing) > 0 {
+			msg := fmt.Sprintf("missing required labels: %s", strings.Join(missing, ", "))
+			log.Warnf("Reject %s: %s", key, msg)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.ErrorState, msg)
+		}
+		if max := pj.Spec.MaxConcurrency; max > 0 {
+			active, err := c.CountActivePipelineRuns(ctx, jobLabel(*pj))
+			if err != nil {
+				return fmt.Errorf("count active pipelineruns: %v", err)
+			}
+			if active >= max {
+				log.Infof("Throttle %s: %d/%d runs of %s active", key, active, max, pj.Spec.Job)
+				c.RequeueAfter(key, throttleDelay)
+				afterState = prowjobv1.TriggeredState
+				return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.TriggeredState, descThrottled)
+			}
+		}
+		// Reuse the build id kept by an earlier attempt, so every retry creates the same run
+		vended := pj.Status.BuildID == ""
+		pj = pj.DeepCopy() // never vend into the informer's copy, where a failed attempt's id would linger
+		if vended {
+			id, url, err := c.PipelineID(*pj)
+			if err != nil {
+				return fmt.Errorf("failed to get pipeline id: %v", err)
+			}
+			pj.Status.BuildID = id
+			pj.Status.URL = url
+		}
+		newPipelineRun = true
+		skipCloning := skipsCloning(*pj, opts)
+		switch {
+		case skipCloning:
+			log.Infof("Skip cloning %s: ignoring refs because decoration_config.skip_cloning is set", key)
+		case conflictingSkipCloning(*pj):
+			log.Infof("Clone refs for %s despite decoration_config.skip_cloning", key)
+		}
+		var pr *pipelinev1alpha1.PipelineResource
+		if createsResource(*pj, opts) {
+			pr = makePipelineResource(*pj, opts)
+			log.Infof("Create PipelineResource/%s", key)
+			switch created, err := c.CreatePipelineResource(goCtx, ctx, namespace, pr); {
+			case apierrors.IsAlreadyExists(err):
+				// Created by an earlier attempt at this reconcile
+				log.Infof("Reuse existing PipelineResource/%s", key)
+			case transientError(err):
+				if vended {
+					keepBuildID(c, log, key, pj)
+				}
+				return fmt.Errorf("create PipelineResource/%s: %v", key, err)
+			case err != nil:
+				jerr := fmt.Errorf("create pipeline resource: %v", err)
+				c.RecordEvent(pj, untypedcorev1.EventTypeWarning, reasonResourceCreateFailed, jerr.Error())
+				// Retrying will not help, so fail the job rather than loop on it
+				afterState = prowjobv1.ErrorState
+				return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, jerr.Error())
+			default:
+				pr = created
+			}
+		}
+		// Mutated by the hook before validating, so the hook cannot slip an invalid run past us
+		newp, err := generatePipelineRun(c, withPipelineRunSpec(*pj, spec), pr, opts)
+		if herr, ok := err.(preCreateError); ok {
+			msg := herr.Error()
+			c.RecordEvent(pj, untypedcorev1.EventTypeWarning, reasonPipelineRunCreateFailed, msg)
+			log.Warnf("Reject %s: %s", key, msg)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, msg)
+		}
+		if err != nil {
+			return fmt.Errorf("make PipelineRun/%s: %v", key, err)
+		}
+		if err := validatePipelineRunSpec(newp.Spec); err != nil {
+			msg := fmt.Sprintf("invalid PipelineRunSpec: %v", err)
+			log.Warnf("Reject %s: %s", key, msg)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, msg)
+		}
+		if err := validatePipelineRunSize(*newp, opts.maxRunBytes); err != nil {
+			log.Warnf("Reject %s: %v", key, err)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, err.Error())
+		}
+		if sa := gcsServiceAccount(*pj, *newp, opts); sa != nil {
+			log.Infof("Create ServiceAccount/%s for %s", sa.Name, key)
+			switch _, err := c.CreateServiceAccount(ctx, namespace, sa); {
+			case apierrors.IsAlreadyExists(err):
+				// Shared by every job uploading with the same credentials
+			case transientError(err):
+				if vended {
+					keepBuildID(c, log, key, pj)
+				}
+				return fmt.Errorf("create ServiceAccount/%s for %s: %v", sa.Name, key, err)
+			case err != nil:
+				jerr := fmt.Errorf("create gcs service account: %v", err)
+				c.RecordEvent(pj, untypedcorev1.EventTypeWarning, reasonServiceAccountFailed, jerr.Error())
+				afterState = prowjobv1.ErrorState
+				return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, jerr.Error())
+			}
+		}
+		log.Infof("Create PipelineRun/%s", key)
+		p, err = c.CreatePipelineRun(goCtx, ctx, namespace, newp)
+		var adopted bool
+		if apierrors.IsAlreadyExists(err) {
+			// Created by an earlier attempt whose prowjob update was lost, so carry on with that run
+			existing, gerr := c.FetchPipelineRun(ctx, namespace, newp.Name)
+			if gerr != nil {
+				return fmt.Errorf("get existing PipelineRun/%s: %v", key, gerr)
+			}
+			if opts.owns(*existing) {
+				log.Infof("Adopt existing PipelineRun/%s", key)
+				p, err, adopted = existing, nil, true
+				if id := runBuildID(*p, buildIDParamName(*pj, opts)); id != "" {
+					pj.Status.BuildID = id
+				}
+			}
+		}
+		if transientError(err) {
+			// Such as Tekton's admission webhook restarting during an upgrade
+			if vended {
+				keepBuildID(c, log, key, pj)
+			}
+			return fmt.Errorf("create PipelineRun/%s: %v", key, err)
+		}
+		if err != nil {
+			jerr := fmt.Errorf("start pipeline: %v", err)
+			c.RecordEvent(pj, untypedcorev1.EventTypeWarning, reasonPipelineRunCreateFailed, jerr.Error())
+			// Set the prow job in error state to avoid an endless loop when
+			// the pipeline cannot be executed (e.g. referenced pipeline does not exist)
+			afterState = prowjobv1.ErrorState
+			return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, prowjobv1.ErrorState, jerr.Error())
+		}
+		if !adopted {
+			c.RecordEvent(pj, untypedcorev1.EventTypeNormal, reasonPipelineRunCreated, fmt.Sprintf("Created PipelineRun %s/%s", p.Namespace, p.Name))
+		}
+		if pj.Annotations == nil {
+			pj.Annotations = map[string]string{}
+		}
+		pj.Annotations[runNameAnnotation] = p.Name
+		pj.Annotations[runNamespaceAnnotation] = p.Namespace
+		switch url, err := runURL(opts.runURLTemplate, *p); {
+		case err != nil:
+			log.WithError(err).Warnf("Failed to render run URL for %s", key)
+		case url != "":
+			pj.Annotations[runURLAnnotation] = url
+		}
+		if opts.cancelSuperseded && pj.Spec.Type == prowjobv1.PresubmitJob {
+			cancelSuperseded(goCtx, c, log, ctx, *pj)
+		}
+	}
+
+	if p == nil {
+		return fmt.Errorf("no pipelinerun found or created for %q, wantPipelineRun was %v", key, wantPipelineRun)
+	}
+	if !newPipelineRun {
+		warnSpecDrift(log, key, *p)
+	}
+	if !newPipelineRun && opts.fixDrift && spec != nil {
+		if p, err = fixSpecDrift(c, log, ctx, namespace, key, withPipelineRunSpec(*pj, spec), p, opts); err != nil {
+			return err
+		}
+	}
+	wantState, wantMsg := prowJobStatus(p.Status, opts.reasonStates)
+	wantMsg = truncateDescription(wantMsg, opts.descriptionLength())
+	afterState = wantState
+	if beforeState == prowjobv1.TriggeredState && wantState != prowjobv1.TriggeredState {
+		// First time we see the run started
+		observeStartLatency(ctx, pj.Status.StartTime, p.Status.StartTime)
+	}
+	pj = withRunTimes(pj, p.Status, wantState)
+	return updateProwJobState(goCtx, c, log, key, newPipelineRun, pj, wantState, wantMsg)
+}
+
+// cancelSuperseded cancels the unfinished runs of older builds of the presubmit pj for the same pull,
+// and aborts their prowjobs, since a newer build makes their results moot. Failures are only logged,
+// as they leave an older run to finish rather than anything broken.
+func cancelSuperseded(goCtx context.Context, c reconciler, log *logrus.Entry, ctx string, pj prowjobv1.ProwJob) {
+	runs, err := c.ListPipelineRuns(ctx, jobLabel(pj))
+	if err != nil {
+		log.WithError(err).Warn("Failed to list runs to cancel superseded builds")
+		return
+	}
+	for _, r := range runs {
+		name := r.Labels[kube.ProwJobIDLabel]
+		if name == "" || name == pj.Name || r.DeletionTimestamp != nil || finishedPipelineRun(r.Status) ||
+			r.Spec.Status == pipelinev1alpha1.PipelineRunSpecStatusCancelled {
+			continue
+		}
+		old, err := c.GetProwJob(name)
+		if err != nil {
+			if !apierrors.IsNotFound(err) { // orphans are cleaned up elsewhere
+				log.WithError(err).Warnf("Failed to get prowjob %s to check if it is superseded", name)
+			}
+			continue
+		}
+		if !supersedes(pj, *old) {
+			continue
+		}
+		log.Infof("Cancel PipelineRun/%s/%s: build %s superseded by %s", r.Namespace, r.Name, old.Name, pj.Name)
+		r.Spec.Status = pipelinev1alpha1.PipelineRunSpecStatusCancelled
+		if _, err := c.UpdatePipelineRun(ctx, r.Namespace, &r); err != nil {
+			log.WithError(err).Warnf("Failed to cancel superseded PipelineRun/%s/%s", r.Namespace, r.Name)
+			continue
+		}
+		if finalState(old.Status.State) {
+			continue
+		}
+		msg := fmt.Sprintf("superseded by %s", pj.Name)
+		if err := updateProwJobState(goCtx, c, log, toKey(ctx, r.Namespace, name), false, old, prowjobv1.AbortedState, msg); err != nil {
+			log.WithError(err).Warnf("Failed to abort superseded prowjob %s", name)
+		}
+	}
+}
+
+// supersedes returns true when pj is a newer build of the same presubmit job for the same pull as old.
+func supersedes(pj, old prowjobv1.ProwJob) bool {
+	switch {
+	case old.Spec.Type != prowjobv1.PresubmitJob, old.Spec.Job != pj.Spec.Job:
+		return false
+	case old.Spec.Refs == nil, pj.Spec.Refs == nil:
+		return false
+	case old.Spec.Refs.Org != pj.Spec.Refs.Org, old.Spec.Refs.Repo != pj.Spec.Refs.Repo:
+		return false
+	case len(old.Spec.Refs.Pulls) == 0, len(pj.Spec.Refs.Pulls) == 0:
+		return false
+	case old.Spec.Refs.Pulls[0].Number != pj.Spec.Refs.Pulls[0].Number:
+		return false
+	}
+	return old.Status.StartTime.Before(&pj.Status.StartTime)
+}
+
+// configMapPipelineRunSpec reads the PipelineRunSpec YAML at ref, the name/key of a ConfigMap in the prowjob namespace.
+func configMapPipelineRunSpec(c reconciler, ref string) (*pipelinev1alpha1.PipelineRunSpec, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%s %q is not name/key", specConfigMapAnnotation, ref)
+	}
+	name, key := parts[0], parts[1]
+	cm, err := c.GetConfigMap(name)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s has no key %s", name, key)
+	}
+	var spec pipelinev1alpha1.PipelineRunSpec
+	if err := yaml.Unmarshal([]byte(data), &spec); err != nil {
+		return nil, fmt.Errorf("configmap %s key %s: %v", name, key, err)
+	}
+	return &spec, nil
+}
+
+// keepBuildID saves the build id this reconcile vended onto the prowjob before the create is retried,
+// so the retry does not ask tot for another one.
+func keepBuildID(c reconciler, log *logrus.Entry, key string, pj *prowjobv1.ProwJob) {
+	if _, err := c.UpdateProwJob(pj); err != nil {
+		log.WithError(err).Warnf("Failed to keep the build id of %s", key)
+	}
+}
+
+// runBuildID returns the build id a pipeline run was created with, or "" when it has no such param.
+func runBuildID(p pipelinev1alpha1.PipelineRun, name string) string {
+	for _, param := range p.Spec.Params {
+		if param.Name == name {
+			return param.Value
+		}
+	}
+	return ""
+}
+
+// withPipelineRunSpec returns a copy of pj running spec, leaving pj itself untouched.
+func withPipelineRunSpec(pj prowjobv1.ProwJob, spec *pipelinev1alpha1.PipelineRunSpec) prowjobv1.ProwJob {
+	pj.Spec.PipelineRunSpec = spec
+	return pj
+}
+
+// fixSpecDrift restores the spec we would generate for the prowjob onto a run that has not started yet.
+// Runs are left alone once started, since Tekton does not act on spec changes to a running pipeline.
+func fixSpecDrift(c reconciler, log *logrus.Entry, ctx, namespace, key string, pj prowjobv1.ProwJob, p *pipelinev1alpha1.PipelineRun, opts PipelineOptions) (*pipelinev1alpha1.PipelineRun, error) {
+	var pr *pipelinev1alpha1.PipelineResource
+	if createsResource(pj, opts) {
+		pr = makePipelineResource(pj, opts)
+	}
+	want, err := generatePipelineRun(c, pj, pr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("make PipelineRun/%s: %v", key, err)
+	}
+	if !specChanged(*p, *want) {
+		return p, nil
+	}
+	if !p.Status.StartTime.IsZero() {
+		log.Warnf("Leave drifted PipelineRun/%s: already started", key)
+		return p, nil
+	}
+	np := p.DeepCopy()
+	np.Spec = want.Spec
+	if np.Spec.Timeout == nil {
+		np.Spec.Timeout = p.Spec.Timeout
+	}
+	if sum, ok := want.Annotations[specChecksumAnnotation]; ok {
+		if np.Annotations == nil {
+			np.Annotations = map[string]string{}
+		}
+		np.Annotations[specChecksumAnnotation] = sum // so the restored run no longer looks drifted
+	}
+	log.Infof("Restore drifted PipelineRun/%s", key)
+	updated, err := c.UpdatePipelineRun(ctx, namespace, np)
+	if err != nil {
+		return nil, fmt.Errorf("update PipelineRun/%s: %v", key, err)
+	}
+	return updated, nil
+}
+
+// specChanged returns true when the live run's spec differs from the one we would generate now.
+// When both runs recorded a checksum, differing checksums mean the generated spec itself changed, without diffing the specs.
+func specChanged(have, want pipelinev1alpha1.PipelineRun) bool {
+	if h, w := have.Annotations[specChecksumAnnotation], want.Annotations[specChecksumAnnotation]; h != "" && w != "" && h != w {
+		return true
+	}
+	return specDrifted(have.Spec, want.Spec)
+}
+
+// specDrifted returns true when the live spec differs from the one we generated.
+// Fields we leave unset may be defaulted by Tekton's webhook, so only a live value for a field we set counts as drift.
+func specDrifted(have, want pipelinev1alpha1.PipelineRunSpec) bool {
+	if want.Timeout == nil {
+		have.Timeout = nil
+	}
+	return !equality.Semantic.DeepEqual(have, want)
+}
+
+// rejectUnknownContext moves an unfinished jenkins-x prowjob targeting an unconfigured context to error state.
+func rejectUnknownContext(goCtx context.Context, c reconciler, log *logrus.Entry, key, name string, cerr error) error {
+	pj, err := c.GetProwJob(name)
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("get prowjob: %v", err)
+	case pj.Spec.Agent != jenkinsXAgent, finalState(pj.Status.State):
+		return nil
+	}
+	log.Warnf("Reject %s: %v", key, cerr)
+	return updateProwJobState(goCtx, c, log, key, false, pj, prowjobv1.ErrorState, cerr.Error())
+}
+
+// withRunTimes fills in the prowjob's unset start and completion times from the run's, rather than
+// leaving them to the controller's clock, so delayed reconciles and clock skew do not distort durations.
+func withRunTimes(pj *prowjobv1.ProwJob, ps pipelinev1alpha1.PipelineRunStatus, state prowjobv1.ProwJobState) *prowjobv1.ProwJob {
+	setStart := pj.Status.StartTime.IsZero() && !ps.StartTime.IsZero()
+	setCompletion := pj.Status.CompletionTime.IsZero() && !ps.CompletionTime.IsZero() && finalState(state)
+	if !setStart && !setCompletion {
+		return pj
+	}
+	pj = pj.DeepCopy()
+	if setStart {
+		pj.Status.StartTime = *ps.StartTime.DeepCopy()
+	}
+	if setCompletion {
+		pj.Status.CompletionTime = ps.CompletionTime.DeepCopy()
+	}
+	return pj
+}
+
+func updateProwJobState(goCtx context.Context, c reconciler, log *logrus.Entry, key string, newPipelineRun bool, pj *prowjobv1.ProwJob, state prowjobv1.ProwJobState, msg string) error {
+	haveState := pj.Status.State
+	haveMsg := pj.Status.Description
+	if newPipelineRun || haveState != state || haveMsg != msg {
+		npj := pj.DeepCopy()
+		if npj.Status.StartTime.IsZero() {
+			npj.Status.StartTime = c.Now()
+		}
+		if npj.Status.CompletionTime.IsZero() && finalState(state) {
+			now := c.Now()
+			npj.Status.CompletionTime = &now
+		}
+		npj.Status.State = state
+		npj.Status.Description = msg
+		log.Infof("Update ProwJob/%s: %s -> %s", key, haveState, state)
+		attempt := npj
+		var finished bool
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := goCtx.Err(); err != nil {
+				return err
+			}
+			_, err := c.UpdateProwJob(attempt)
+			if !apierrors.IsConflict(err) {
+				return err
+			}
+			// Someone else, such as crier, updated the prowjob first.
+			// The lister may not have that version yet, so ask the API server.
+			log.Infof("Conflict updating ProwJob/%s, retrying on the latest version", key)
+			latest, gerr := c.FetchProwJob(npj.Name)
+			if gerr != nil {
+				return fmt.Errorf("get latest prowjob: %v", gerr)
+			}
+			if finalState(latest.Status.State) {
+				// Such as aborted by a newer build, which must not be undone
+				log.Infof("Leave ProwJob/%s: already %s", key, latest.Status.State)
+				finished = true
+				return nil
+			}
+			attempt = reapplyProwJobUpdate(*latest, *npj, newPipelineRun)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("update prow status: %v", err)
+		}
+		if finished {
+			return nil
+		}
+		if state == prowjobv1.ErrorState && haveState != state {
+			c.RecordEvent(npj, untypedcorev1.EventTypeWarning, reasonProwJobErrored, msg)
+		}
+	}
+	return nil
+}
+
+// transientError returns true for API errors a later retry may succeed past, such as timeouts and throttling.
+// The API server reports an admission webhook it cannot call as an internal error, whereas a webhook
+// rejecting the object is a bad request or invalid, and so permanent.
+func transientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err) || apierrors.IsConflict(err) ||
+		apierrors.IsServiceUnavailable(err) || connectionRefused(err) || utilnet.IsConnectionReset(err) ||
+		netTimeout(err)
+}
+
+// connectionRefused returns true when the API server refused the connection.
+// The vendored apimachinery only detects resets, so this unwraps the same way IsConnectionReset does.
+func connectionRefused(err error) bool {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && errno == syscall.ECONNREFUSED
+}
+
+// netTimeout returns true when err is a network timeout reaching the API server.
+func netTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// reapplyProwJobUpdate applies what this reconcile changed to a newer version of the prowjob: the state and
+// description, the start and completion times where still unset and, when it created the run, the run's
+// annotations and build id. Everything else keeps the newer version's value.
+func reapplyProwJobUpdate(latest, want prowjobv1.ProwJob, newPipelineRun bool) *prowjobv1.ProwJob {
+	npj := latest.DeepCopy()
+	npj.Status.State = want.Status.State
+	npj.Status.Description = want.Status.Description
+	if npj.Status.StartTime.IsZero() {
+		npj.Status.StartTime = want.Status.StartTime
+	}
+	if npj.Status.CompletionTime.IsZero() {
+		npj.Status.CompletionTime = want.Status.CompletionTime.DeepCopy()
+	}
+	if !newPipelineRun {
+		return npj
+	}
+	for _, k := range []string{runNameAnnotation, runNamespaceAnnotation, runURLAnnotation} {
+		v, ok := want.Annotations[k]
+		if !ok {
+			continue
+		}
+		if npj.Annotations == nil {
+			npj.Annotations = map[string]string{}
+		}
+		npj.Annotations[k] = v
+	}
+	npj.Status.BuildID = want.Status.BuildID
+	npj.Status.URL = want.Status.URL
+	return npj
+}
+
+// runURL renders the link to a pipeline run's logs, or returns an empty string without a template
+func runURL(tmpl *template.Template, p pipelinev1alpha1.PipelineRun) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, p); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// specChecksum returns a hex-encoded sha256 of the pipeline run spec
+func specChecksum(spec pipelinev1alpha1.PipelineRunSpec) (string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// warnSpecDrift logs when a run's spec no longer matches the checksum recorded when we created it
+func warnSpecDrift(log *logrus.Entry, key string, p pipelinev1alpha1.PipelineRun) {
+	want, ok := p.Annotations[specChecksumAnnotation]
+	if !ok {
+		return
+	}
+	have, err := specChecksum(p.Spec)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to checksum PipelineRun/%s", key)
+		return
+	}
+	if have != want {
+		log.Warnf("Drift PipelineRun/%s: spec checksum %s != recorded %s", key, have, want)
+	}
+}
+
+// finishedPipelineRun returns true if the pipeline run has reached a terminal condition
+func finishedPipelineRun(ps pipelinev1alpha1.PipelineRunStatus) bool {
+	cond := ps.GetCondition(duckv1alpha1.ConditionSucceeded)
+	return cond != nil && cond.Status != untypedcorev1.ConditionUnknown
+}
+
+// finalState returns true if the prowjob has already finished
+func finalState(status prowjobv1.ProwJobState) bool {
+	switch status {
+	case "", prowjobv1.PendingState, prowjobv1.TriggeredState:
+		return false
+	}
+	return true
+}
+
+// description computes the ProwJobStatus description for this condition or falling back to a default if none is provided.
+func description(cond duckv1alpha1.Condition, fallback string) string {
+	switch {
+	case cond.Message != "":
+		return cond.Message
+	case cond.Reason != "":
+		return cond.Reason
+	}
+	return fallback
+}
+
+const (
+	descScheduling       = "scheduling"
+	descInitializing     = "initializing"
+	descRunning          = "running"
+	descSucceeded        = "succeeded"
+	descFailed           = "failed"
+	descUnknown          = "unknown status"
+	descMissingCondition = "missing end condition"
+	descThrottled        = "waiting for max concurrency"
+	descRunDeleted       = "pipeline run deleted"
+
+	// defaultDescriptionLength keeps descriptions within what a GitHub status description can show
+	defaultDescriptionLength = 140
+)
+
+// reasonState is the prowjob state, and optionally the description, a pipeline condition reason maps to.
+type reasonState struct {
+	state       prowjobv1.ProwJobState
+	description string
+}
+
+// prowJobStatus returns the desired state and description based on the pipeline status
+// The Succeeded condition takes precedence whenever it is present, whatever its status.
+// Ready is only consulted without it and never moves the job past triggered/scheduling,
+// since it may be stale or set before Tekton has reconciled the run.
+// A Succeeded reason found in reasons maps to its configured state instead of the default one.
+func prowJobStatus(ps pipelinev1alpha1.PipelineRunStatus, reasons map[string]reasonState) (prowjobv1.ProwJobState, string) {
+	started := ps.StartTime
+	finished := ps.CompletionTime
+	pcond := ps.GetCondition(duckv1alpha1.ConditionSucceeded)
+	if pcond == nil {
+		if !finished.IsZero() {
+			return prowjobv1.ErrorState, descMissingCondition
+		}
+		if ready := ps.GetCondition(duckv1alpha1.ConditionReady); ready != nil {
+			logrus.Debugf("Ignoring %s=%s condition without %s", ready.Type, ready.Status, duckv1alpha1.ConditionSucceeded)
+		}
+		return prowjobv1.TriggeredState, descScheduling
+	}
+	cond := *pcond
+	// Only a finished run's reason may override its state, so a mapped reason cannot finish a running job
+	if rs, ok := reasons[cond.Reason]; ok && cond.Reason != "" && cond.Status != untypedcorev1.ConditionUnknown {
+		if rs.description != "" {
+			return rs.state, rs.description
+		}
+		return rs.state, description(cond, cond.Reason)
+	}
+	switch {
+	case cond.Status == untypedcorev1.ConditionTrue:
+		return prowjobv1.SuccessState, description(cond, descSucceeded)
+	case cond.Status == untypedcorev1.ConditionFalse:
+		if detail := failedTask(ps); detail != "" {
+			return prowjobv1.FailureState, fmt.Sprintf("%s: %s", descFailed, detail)
+		}
+		return prowjobv1.FailureState, description(cond, descFailed)
+	case started.IsZero():
+		return prowjobv1.TriggeredState, description(cond, descInitializing)
+	case cond.Status == untypedcorev1.ConditionUnknown, finished.IsZero():
+		if task := runningTask(ps); task != "" {
+			return prowjobv1.PendingState, fmt.Sprintf("%s: %s", descRunning, task)
+		}
+		return prowjobv1.PendingState, description(cond, descRunning)
+	}
+
+	logrus.Warnf("Unknown condition %#v", cond)
+	return prowjobv1.ErrorState, description(cond, descUnknown) // shouldn't happen
+}
+
+// runningTask returns the name of the first pipeline task that has not finished, if any
+func runningTask(ps pipelinev1alpha1.PipelineRunStatus) string {
+	for _, k := range sets.StringKeySet(ps.TaskRuns).List() { // deterministic ordering
+		tr := ps.TaskRuns[k]
+		if tr == nil || tr.Status == nil {
+			continue
+		}
+		if cond := tr.Status.GetCondition(duckv1alpha1.ConditionSucceeded); cond != nil && cond.Status != untypedcorev1.ConditionUnknown {
+			continue
+		}
+		if tr.PipelineTaskName != "" {
+			return tr.PipelineTaskName
+		}
+		return k
+	}
+	return ""
+}
+
+// failedTask describes the first failed pipeline task and its failing step, if any
+func failedTask(ps pipelinev1alpha1.PipelineRunStatus) string {
+	for _, k := range sets.StringKeySet(ps.TaskRuns).List() { // deterministic ordering
+		tr := ps.TaskRuns[k]
+		if tr == nil || tr.Status == nil {
+			continue
+		}
+		cond := tr.Status.GetCondition(duckv1alpha1.ConditionSucceeded)
+		if cond == nil || cond.Status != untypedcorev1.ConditionFalse {
+			continue
+		}
+		task := tr.PipelineTaskName
+		if task == "" {
+			task = k
+		}
+		// The vendored StepState has no step name, so steps are numbered from 1 in their run order
+		for i, step := range tr.Status.Steps {
+			term := step.Terminated
+			if term == nil || term.ExitCode == 0 {
+				continue
+			}
+			detail := fmt.Sprintf("%s: step %d exited %d", task, i+1, term.ExitCode)
+			if msg := strings.TrimSpace(term.Message); msg != "" {
+				detail += ": " + msg
+			}
+			return detail
+		}
+		return fmt.Sprintf("%s: %s", task, description(*cond, descFailed))
+	}
+	return ""
+}
+
+// truncateDescription shortens s to at most max runes, marking where it was cut.
+// Counting runes rather than bytes never splits a multibyte character.
+func truncateDescription(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	const ellipsis = "..."
+	runes := []rune(s)
+	if max <= len(ellipsis) {
+		return string(runes[:max])
+	}
+	return string(runes[:max-len(ellipsis)]) + ellipsis
+}
+
+// pipelineMeta builds the pipeline metadata from prow job definition
+func pipelineMeta(pj prowjobv1.ProwJob, opts PipelineOptions) metav1.ObjectMeta {
+	labels, annotations := jobLabelsAndAnnotations(pj)
+	if pj.Spec.MaxConcurrency > 0 {
+		annotations[maxConcurrencyAnnotation] = strconv.Itoa(pj.Spec.MaxConcurrency)
+	}
+	for k, v := range opts.extraLabels {
+		if _, ok := labels[k]; !ok { // never replace the labels prow relies on
+			labels[k] = v
+		}
+	}
+	key, value := opts.ownerLabel()
+	labels[key] = value
+	return metav1.ObjectMeta{
+		Annotations: annotations,
+		Name:        pj.Name,
+		Namespace:   jobPipelineNamespace(pj, opts, pj.Spec.Namespace),
+		Labels:      labels,
+	}
+}
+
+// jobLabelsAndAnnotations returns prow's labels and annotations for the prowjob's objects, with valid label values.
+// decorate drops labels with invalid values, so the labels it derives from the job name and refs are restored sanitized.
+func jobLabelsAndAnnotations(pj prowjobv1.ProwJob) (map[string]string, map[string]string) {
+	if len(pj.Labels) > 0 {
+		sanitized := make(map[string]string, len(pj.Labels))
+		for k, v := range pj.Labels {
+			sanitized[k] = sanitizeLabelValue(v)
+		}
+		pj.Labels = sanitized
+	}
+	labels, annotations := decorate.LabelsAndAnnotationsForJob(pj)
+	derived := map[string]string{kube.ProwJobAnnotation: pj.Spec.Job}
+	if refs := pj.Spec.Refs; refs != nil {
+		derived[kube.OrgLabel] = refs.Org
+		derived[kube.RepoLabel] = refs.Repo
+	}
+	for k, v := range derived {
+		if _, ok := labels[k]; !ok && v != "" {
+			labels[k] = v
+		}
+	}
+	for k, v := range labels {
+		labels[k] = sanitizeLabelValue(v)
+	}
+	return labels, annotations
+}
+
+// sanitizeLabelValue coerces v into a valid label value, so long or unusual repo and job names do not fail admission.
+// Invalid characters become underscores and the value is trimmed to the allowed length and to alphanumeric ends.
+func sanitizeLabelValue(v string) string {
+	if len(validation.IsValidLabelValue(v)) == 0 {
+		return v
+	}
+	v = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, v)
+	if len(v) > validation.LabelValueMaxLength {
+		v = v[:validation.LabelValueMaxLength]
+	}
+	return strings.TrimFunc(v, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+}
+
+// validateTektonVersion ensures the prowjob does not request a Tekton API version we cannot build.
+// Only v1alpha1 objects are supported until the controller vendors a newer Tekton API.
+func validateTektonVersion(pj prowjobv1.ProwJob) error {
+	switch v := pj.Annotations[tektonVersionAnnotation]; v {
+	case "", "v1alpha1":
+		return nil
+	case "v1beta1":
+		return fmt.Errorf("tekton version %s is not supported by this controller", v)
+	default:
+		return fmt.Errorf("invalid %s annotation %q: must be v1alpha1 or v1beta1", tektonVersionAnnotation, v)
+	}
+}
+
+// validateResourceType ensures the prowjob requests a pipeline resource type we know how to build.
+func validateResourceType(pj prowjobv1.ProwJob) error {
+	switch t := pipelineResourceType(pj); t {
+	case pipelinev1alpha1.PipelineResourceTypeGit:
+		return nil
+	case pipelinev1alpha1.PipelineResourceTypeStorage:
+		if pj.Annotations[storageLocationAnnotation] == "" {
+			return fmt.Errorf("%s resources require a %s annotation", t, storageLocationAnnotation)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid %s annotation %q: must be git or storage", resourceTypeAnnotation, t)
+	}
+}
+
+// validateJobNamespace ensures a namespace the prowjob picks for its pipeline objects is a valid namespace name
+// the operator allows, so job authors cannot put pipelines, and the credentials they run with, anywhere on the cluster.
+func (o PipelineOptions) validateJobNamespace(pj prowjobv1.ProwJob) error {
+	ns := pj.Annotations[jobNamespaceAnnotation]
+	if ns == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+		return fmt.Errorf("invalid %s annotation %q: %s", jobNamespaceAnnotation, ns, strings.Join(errs, "; "))
+	}
+	if !sets.NewString(o.jobNamespaces...).Has(ns) {
+		return fmt.Errorf("%s annotation %q is not an allowed namespace", jobNamespaceAnnotation, ns)
+	}
+	return nil
+}
+
+// jobPipelineNamespace returns the namespace for the prowjob's pipeline objects, given the one it is keyed under:
+// its namespace annotation, else the context's override, else ns.
+func jobPipelineNamespace(pj prowjobv1.ProwJob, opts PipelineOptions, ns string) string {
+	if n := pj.Annotations[jobNamespaceAnnotation]; n != "" {
+		return n
+	}
+	return opts.pipelineNamespace(ns)
+}
+
+// validatePipelineRunSize rejects runs whose serialized size exceeds max bytes, when max is set,
+// rather than letting the API server fail to store them with an opaque error.
+func validatePipelineRunSize(p pipelinev1alpha1.PipelineRun, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("serialize PipelineRun: %v", err)
+	}
+	if len(b) > max {
+		return fmt.Errorf("PipelineRun is %d bytes, over the %d byte limit", len(b), max)
+	}
+	return nil
+}
+
+// validatePipelineRunSpec catches mistakes Tekton would otherwise reject at admission with a less helpful error.
+// The referenced Pipeline is not fetched, so params and resources are only checked against each other.
+func validatePipelineRunSpec(spec pipelinev1alpha1.PipelineRunSpec) error {
+	if spec.PipelineRef.Name == "" {
+		return errors.New("pipelineRef.name is required")
+	}
+	bindings := sets.NewString()
+	for i, rb := range spec.Resources {
+		switch {
+		case rb.Name == "":
+			return fmt.Errorf("resources[%d] has no name", i)
+		case rb.ResourceRef.Name == "":
+			return fmt.Errorf("resource %q has no resourceRef.name", rb.Name)
+		case bindings.Has(rb.Name):
+			return fmt.Errorf("resource %q is bound more than once, note the controller binds the git resource under the prowjob name", rb.Name)
+		}
+		bindings.Insert(rb.Name)
+	}
+	params := sets.NewString()
+	for i, p := range spec.Params {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("params[%d] has no name", i)
+		case params.Has(p.Name):
+			return fmt.Errorf("param %q is set more than once, rename it or set --param-prefix", p.Name)
+		}
+		params.Insert(p.Name)
+	}
+	return nil
+}
+
+// missingLabels returns the required label keys absent from the prowjob
+func missingLabels(pj prowjobv1.ProwJob, required []string) []string {
+	var missing []string
+	for _, k := range required {
+		if _, ok := pj.Labels[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+// jobLabel returns the value of the job name label applied to the prowjob's pipeline runs
+func jobLabel(pj prowjobv1.ProwJob) string {
+	labels, _ := jobLabelsAndAnnotations(pj)
+	return labels[kube.ProwJobAnnotation]
+}
+
+// createsResource returns true when the job's run checks out from a pipeline resource we create
+func createsResource(pj prowjobv1.ProwJob, opts PipelineOptions) bool {
+	return !opts.paramsOnly && !skipsCloning(pj, opts)
+}
+
+// skipsCloning returns true when no git resource should be created for the job
+func skipsCloning(pj prowjobv1.ProwJob, opts PipelineOptions) bool {
+	return conflictingSkipCloning(pj) && opts.preferSkipCloning
+}
+
+// conflictingSkipCloning returns true when the job has refs to clone but also asks to skip cloning
+func conflictingSkipCloning(pj prowjobv1.ProwJob) bool {
+	dc := pj.Spec.DecorationConfig
+	return pj.Spec.Refs != nil && dc != nil && dc.SkipCloning != nil && *dc.SkipCloning
+}
+
+// defaultEnv adds the map of environment variables to the container, except keys already defined.
+func defaultEnv(c *untypedcorev1.Container, rawEnv map[string]string) {
+	keys := sets.String{}
+	for _, arg := range c.Env {
+		keys.Insert(arg.Name)
+	}
+	for _, k := range sets.StringKeySet(rawEnv).List() { // deterministic ordering
+		if keys.Has(k) {
+			continue
+		}
+		c.Env = append(c.Env, untypedcorev1.EnvVar{Name: k, Value: rawEnv[k]})
+	}
+}
+
+// sourceURL returns the source URL from prow jobs repository reference, or an empty string if the refs do not name a repository
+func sourceURL(pj prowjobv1.ProwJob, opts PipelineOptions) string {
+	return refsURL(pj.Spec.Refs, opts)
+}
+
+// refsURL returns the url to clone refs from, or an empty string when the refs name no repository
+func refsURL(refs *prowjobv1.Refs, opts PipelineOptions) string {
+	switch {
+	case refs == nil:
+		return ""
+	case refs.CloneURI != "":
+		return stripCredentials(refs.CloneURI)
+	case refs.RepoLink != "":
+		return strings.TrimSuffix(stripCredentials(refs.RepoLink), "/") + ".git"
+	case refs.Org != "" && refs.Repo != "":
+		host := opts.githubHost
+		if host == "" {
+			host = "github.com"
+		}
+		return fmt.Sprintf("https://%s/%s/%s.git", host, refs.Org, refs.Repo)
+	}
+	return ""
+}
+
+// stripCredentials removes a token embedded in an http(s) clone url, so it never lands in a pipeline object.
+// Other urls are returned as is, since the user of an ssh url such as git@host names an account, not a secret.
+// Pipelines get clone credentials from their service account's git secrets instead.
+func stripCredentials(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// pipelineResourceType returns the type of pipeline resource the prow job checks out from
+func pipelineResourceType(pj prowjobv1.ProwJob) pipelinev1alpha1.PipelineResourceType {
+	if t := pj.Annotations[resourceTypeAnnotation]; t != "" {
+		return pipelinev1alpha1.PipelineResourceType(t)
+	}
+	return pipelinev1alpha1.PipelineResourceTypeGit
+}
+
+// makePipelineResource creates the pipeline resource the prow job checks out from
+func makePipelineResource(pj prowjobv1.ProwJob, opts PipelineOptions) *pipelinev1alpha1.PipelineResource {
+	pr := pipelinev1alpha1.PipelineResource{
+		ObjectMeta: pipelineMeta(pj, opts),
+	}
+	switch pipelineResourceType(pj) {
+	case pipelinev1alpha1.PipelineResourceTypeStorage:
+		pr.Spec = storageResourceSpec(pj)
+	default:
+		pr.Spec = gitResourceSpec(pj, opts)
+	}
+	return &pr
+}
+
+// storageResourceSpec describes a gcs storage resource at the location the prow job names
+func storageResourceSpec(pj prowjobv1.ProwJob) pipelinev1alpha1.PipelineResourceSpec {
+	location := pj.Annotations[storageLocationAnnotation]
+	spec := pipelinev1alpha1.PipelineResourceSpec{
+		Type: pipelinev1alpha1.PipelineResourceTypeStorage,
+		Params: []pipelinev1alpha1.Param{
+			{
+				Name:  "type",
+				Value: "gcs",
+			},
+			{
+				Name:  "location",
+				Value: location,
+			},
+		},
+	}
+	if strings.HasSuffix(location, "/") {
+		spec.Params = append(spec.Params, pipelinev1alpha1.Param{
+			Name:  "dir",
+			Value: "true",
+		})
+	}
+	return spec
+}
+
+// gitResourceSpec describes a git resource checking out the prow job's refs
+func gitResourceSpec(pj prowjobv1.ProwJob, opts PipelineOptions) pipelinev1alpha1.PipelineResourceSpec {
+	spec := pipelinev1alpha1.PipelineResourceSpec{
+		Type: pipelinev1alpha1.PipelineResourceTypeGit,
+		Params: []pipelinev1alpha1.Param{
+			{
+				Name:  "url",
+				Value: sourceURL(pj, opts),
+			},
+			{
+				Name:  "revision",
+				Value: gitRevision(pj, opts),
+			},
+		},
+	}
+	if pj.Spec.Refs != nil && len(pj.Spec.Refs.Pulls) > 1 {
+		spec.Params = append(spec.Params, pipelinev1alpha1.Param{
+			Name:  "pulls",
+			Value: pullSHAs(pj.Spec.Refs.Pulls),
+		})
+	}
+	return spec
+}
+
+// gitParams passes the git refs a resource would check out to the pipeline as params instead.
+// Each extra ref gets its own params named after its org and repo, so pipelines can find them.
+func gitParams(pj prowjobv1.ProwJob, opts PipelineOptions) []pipelinev1alpha1.Param {
+	if skipsCloning(pj, opts) {
+		return nil
+	}
+	var params []pipelinev1alpha1.Param
+	if refs := pj.Spec.Refs; refs != nil {
+		params = append(params, refsParams(opts.paramPrefix+"git_", refs, opts)...)
+		if len(refs.Pulls) > 1 {
+			params = append(params, pipelinev1alpha1.Param{
+				Name:  opts.paramPrefix + "git_pulls",
+				Value: pullSHAs(refs.Pulls),
+			})
+		}
+	}
+	for i, prefix := range extraRefsParamPrefixes(pj.Spec.ExtraRefs) {
+		params = append(params, refsParams(opts.paramPrefix+prefix, &pj.Spec.ExtraRefs[i], opts)...)
+	}
+	return params
+}
+
+// refsParams returns the url and revision params for refs, with names starting with prefix
+func refsParams(prefix string, refs *prowjobv1.Refs, opts PipelineOptions) []pipelinev1alpha1.Param {
+	return []pipelinev1alpha1.Param{
+		{
+			Name:  prefix + "url",
+			Value: refsURL(refs, opts),
+		},
+		{
+			Name:  prefix + "revision",
+			Value: refsRevision(refs, opts),
+		},
+	}
+}
+
+// extraRefsParamPrefix names an extra ref's params after its org and repo, such as extra_org_repo_
+func extraRefsParamPrefix(refs prowjobv1.Refs) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, refs.Org+"_"+refs.Repo)
+	return "extra_" + name + "_"
+}
+
+// extraRefsParamPrefixes returns the param prefix of each extra ref. Refs whose names would collide,
+// such as two refs on one repo or a-b/c and a_b/c, are told apart by their index, such as extra_org_repo_1_.
+func extraRefsParamPrefixes(extraRefs []prowjobv1.Refs) []string {
+	prefixes := make([]string, len(extraRefs))
+	counts := map[string]int{}
+	for i, refs := range extraRefs {
+		prefixes[i] = extraRefsParamPrefix(refs)
+		counts[prefixes[i]]++
+	}
+	used := sets.NewString()
+	for _, prefix := range prefixes {
+		if counts[prefix] == 1 {
+			used.Insert(prefix)
+		}
+	}
+	for i, prefix := range prefixes {
+		if counts[prefix] == 1 {
+			continue
+		}
+		unique := fmt.Sprintf("%s%d_", prefix, i)
+		for used.Has(unique) { // another ref's repo may end in the index
+			unique = fmt.Sprintf("%s%d_", unique, i)
+		}
+		used.Insert(unique)
+		prefixes[i] = unique
+	}
+	return prefixes
+}
+
+// gitRevision returns the revision to check out for the prow job's refs
+func gitRevision(pj prowjobv1.ProwJob, opts PipelineOptions) string {
+	return refsRevision(pj.Spec.Refs, opts)
+}
+
+// refsRevision returns the revision to check out for refs, or an empty string without refs
+func refsRevision(refs *prowjobv1.Refs, opts PipelineOptions) string {
+	var revision string
+	if refs != nil {
+		if len(refs.Pulls) == 1 {
+			revision = refs.Pulls[0].SHA
+		} else {
+			// Batches start from the base, like clonerefs, and merge each pull on top
+			revision = refs.BaseSHA
+			if revision == "" {
+				// Some triggers only name the branch
+				revision = refs.BaseRef
+			}
+		}
+		if revision == "" {
+			revision = opts.defaultRevision
+		}
+		if revision == "" {
+			revision = fallbackRevision
+		}
+	}
+	return revision
+}
+
+// tektonAnnotations returns the annotations toggling Tekton features for the prowjob's run.
+// The prowjob's own tekton.dev annotations take precedence over the configured ones.
+func tektonAnnotations(pj prowjobv1.ProwJob, opts PipelineOptions) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range opts.tektonAnnotations {
+		annotations[k] = v
+	}
+	for k, v := range pj.Annotations {
+		if prefix := strings.SplitN(k, "/", 2)[0]; prefix == "tekton.dev" || strings.HasSuffix(prefix, ".tekton.dev") {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// defaultScheduling copies the pod spec's node selector and affinity into the run spec, except those already set.
+// The vendored Tekton API has no PodTemplate, so these are the run's only scheduling fields; tolerations cannot be carried.
+func defaultScheduling(spec *pipelinev1alpha1.PipelineRunSpec, pod *untypedcorev1.PodSpec) {
+	if pod == nil {
+		return
+	}
+	if len(spec.NodeSelector) == 0 && len(pod.NodeSelector) > 0 {
+		spec.NodeSelector = map[string]string{}
+		for k, v := range pod.NodeSelector {
+			spec.NodeSelector[k] = v
+		}
+	}
+	if spec.Affinity == nil && pod.Affinity != nil {
+		spec.Affinity = pod.Affinity.DeepCopy()
+	}
+}
+
+// gcsParams describes where a decorated job uploads artifacts, computing the path the same way podutils do
+func gcsParams(pj prowjobv1.ProwJob, prefix string) []pipelinev1alpha1.Param {
+	dc := pj.Spec.DecorationConfig
+	if dc == nil || dc.GCSConfiguration == nil {
+		return nil
+	}
+	gc := dc.GCSConfiguration
+	spec := downwardapi.NewJobSpec(pj.Spec, pj.Status.BuildID, pj.Name)
+	params := []pipelinev1alpha1.Param{
+		{
+			Name:  prefix + "gcs_bucket",
+			Value: gc.Bucket,
+		},
+		{
+			Name:  prefix + "gcs_path",
+			Value: path.Join(gc.PathPrefix, gcs.PathForSpec(&spec, repoPathBuilder(*gc))),
+		},
+	}
+	if dc.GCSCredentialsSecret != "" {
+		params = append(params, pipelinev1alpha1.Param{
+			Name:  prefix + "gcs_credentials_secret",
+			Value: dc.GCSCredentialsSecret,
+		})
+	}
+	return params
+}
+
+// gcsCredentialsSecret returns the secret a decorated job uploads to GCS with, if any.
+func gcsCredentialsSecret(pj prowjobv1.ProwJob) string {
+	dc := pj.Spec.DecorationConfig
+	if dc == nil || dc.GCSConfiguration == nil {
+		return ""
+	}
+	return dc.GCSCredentialsSecret
+}
+
+// gcsServiceAccountName names the service account that grants runs the GCS credentials secret.
+func gcsServiceAccountName(secret string) string {
+	return "prow-gcs-" + secret
+}
+
+// gcsServiceAccount returns the service account granting p its prowjob's GCS credentials secret,
+// when the run was given one by makePipelineRun rather than by its author.
+func gcsServiceAccount(pj prowjobv1.ProwJob, p pipelinev1alpha1.PipelineRun, opts PipelineOptions) *untypedcorev1.ServiceAccount {
+	secret := gcsCredentialsSecret(pj)
+	if !opts.gcsServiceAccounts || secret == "" || p.Spec.ServiceAccount != gcsServiceAccountName(secret) {
+		return nil
+	}
+	key, value := opts.ownerLabel()
+	return &untypedcorev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   gcsServiceAccountName(secret),
+			Labels: map[string]string{key: value},
+		},
+		Secrets: []untypedcorev1.ObjectReference{{Name: secret}},
+	}
+}
+
+// repoPathBuilder returns the builder for the configured path strategy, like gcsupload does
+func repoPathBuilder(gc prowjobv1.GCSConfiguration) gcs.RepoPathBuilder {
+	switch gc.PathStrategy {
+	case prowjobv1.PathStrategyExplicit:
+		return gcs.NewExplicitRepoPathBuilder()
+	case prowjobv1.PathStrategySingle:
+		return gcs.NewSingleDefaultRepoPathBuilder(gc.DefaultOrg, gc.DefaultRepo)
+	}
+	return gcs.NewLegacyRepoPathBuilder(gc.DefaultOrg, gc.DefaultRepo)
+}
+
+// pullSHAs describes every pull as number:sha, comma-separated in the order prow merges them
+func pullSHAs(pulls []prowjobv1.Pull) string {
+	var parts []string
+	for _, p := range pulls {
+		parts = append(parts, fmt.Sprintf("%d:%s", p.Number, p.SHA))
+	}
+	return strings.Join(parts, ",")
+}
+
+// generatePipelineRun returns the run we want for a prowjob: the one makePipelineRun builds, adjusted by
+// the pre-create hook. Both creating a run and restoring a drifted one use it, so the hook's changes never
+// look like drift, and the spec checksum covers them.
+func generatePipelineRun(c reconciler, pj prowjobv1.ProwJob, pr *pipelinev1alpha1.PipelineResource, opts PipelineOptions) (*pipelinev1alpha1.PipelineRun, error) {
+	p, err := buildPipelineRun(pj, pr, opts)
+	if err != nil {
+		return nil, err
+	}
+	// A copy, so the hook cannot change the prowjob we go on to update
+	if err := c.MutatePipelineRun(pj.DeepCopy(), p); err != nil {
+		return nil, preCreateError{err: err}
+	}
+	if err := checksumPipelineRun(p, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// makePipeline creates a PipelineRun from a prow job using the PipelineRunSpec defined in the prow job,
+// binding the git resource pr unless it is nil
+func makePipelineRun(pj prowjobv1.ProwJob, pr *pipelinev1alpha1.PipelineResource, opts PipelineOptions) (*pipelinev1alpha1.PipelineRun, error) {
+	p, err := buildPipelineRun(pj, pr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checksumPipelineRun(p, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// buildPipelineRun is makePipelineRun without the spec checksum.
+func buildPipelineRun(pj prowjobv1.ProwJob, pr *pipelinev1alpha1.PipelineResource, opts PipelineOptions) (*pipelinev1alpha1.PipelineRun, error) {
+	if pj.Spec.PipelineRunSpec == nil {
+		return nil, errors.New("no PipelineSpec defined")
+	}
+	p := pipelinev1alpha1.PipelineRun{
+		ObjectMeta: pipelineMeta(pj, opts),
+		Spec:       *pj.Spec.PipelineRunSpec.DeepCopy(),
+	}
+	for k, v := range tektonAnnotations(pj, opts) {
+		if _, ok := p.Annotations[k]; !ok { // never replace the annotations prow relies on
+			p.Annotations[k] = v
+		}
+	}
+	if opts.generateRunNames {
+		p.GenerateName = p.Name + "-"
+		p.Name = ""
+	}
+	defaultScheduling(&p.Spec, pj.Spec.PodSpec)
+	if p.Spec.ServiceAccount == "" {
+		p.Spec.ServiceAccount = opts.serviceAccount
+	}
+	if secret := gcsCredentialsSecret(pj); p.Spec.ServiceAccount == "" && opts.gcsServiceAccounts && secret != "" {
+		p.Spec.ServiceAccount = gcsServiceAccountName(secret)
+	}
+	buildID := pj.Status.BuildID
+	if buildID == "" {
+		return nil, errors.New("empty BuildID in status")
+	}
+	p.Spec.Params = append(p.Spec.Params, pipelinev1alpha1.Param{
+		Name:  buildIDParamName(pj, opts),
+		Value: buildID,
+	})
+	p.Spec.Params = append(p.Spec.Params, gcsParams(pj, opts.paramPrefix)...)
+	if opts.paramsOnly {
+		p.Spec.Params = append(p.Spec.Params, gitParams(pj, opts)...)
+	}
+	if opts.prowBaseURL != "" {
+		p.Spec.Params = append(p.Spec.Params, pipelinev1alpha1.Param{
+			Name:  opts.paramPrefix + "prow_base_url",
+			Value: opts.prowBaseURL,
+		})
+	}
+	if pr != nil {
+		rb := pipelinev1alpha1.PipelineResourceBinding{
+			Name: pr.Name,
+			ResourceRef: pipelinev1alpha1.PipelineResourceRef{
+				Name:       pr.Name,
+				APIVersion: pr.APIVersion,
+			},
+		}
+		p.Spec.Resources = append(p.Spec.Resources, rb)
+	}
+	return &p, nil
+}
+
+// buildIDParamName returns the name of the param a job's pipeline run passes the build id in.
+func buildIDParamName(pj prowjobv1.ProwJob, opts PipelineOptions) string {
+	if name := pj.Annotations[buildIDParamAnnotation]; name != "" {
+		return name
+	}
+	return opts.paramPrefix + "build_id"
+}
+
+// checksumPipelineRun records the checksum of p's final spec when opts.specChecksum is set.
+func checksumPipelineRun(p *pipelinev1alpha1.PipelineRun, opts PipelineOptions) error {
+	if !opts.specChecksum {
+		return nil
+	}
+	sum, err := specChecksum(p.Spec)
+	if err != nil {
+		return fmt.Errorf("checksum spec: %v", err)
+	}
+	if p.Annotations == nil {
+		p.Annotations = map[string]string{}
+	}
+	p.Annotations[specChecksumAnnotation] = sum
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"text/template"
+	"time"
+
+	prowjobv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowjobfake "k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	prowjobinfo "k8s.io/test-infra/prow/client/informers/externalversions"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+
+	pipelinev1alpha1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1alpha1"
+	pipelinefake "github.com/tektoncd/pipeline/pkg/client/clientset/versioned/fake"
+	pipelineinfo "github.com/tektoncd/pipeline/pkg/client/informers/externalversions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jenkins-x/prow-pipeline-controller/pkg/controller"
+)
+
+func ExampleNewReconciler() {
+	// Stands in for tot, vending build ids
+	tot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "1")
+	}))
+	defer tot.Close()
+	// Loading a prow config compiles its job URL template, which is left to the caller here
+	jobURL := template.Must(template.New("JobURL").Parse("https://prow.example.com/{{.Spec.Job}}/{{.Status.BuildID}}"))
+
+	pj := &prowjobv1.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "prowjobs"},
+		Spec: prowjobv1.ProwJobSpec{
+			Type:      prowjobv1.PeriodicJob,
+			Agent:     prowjobv1.ProwJobAgent("jenkins-x"),
+			Job:       "nightly",
+			Namespace: "ci",
+			PipelineRunSpec: &pipelinev1alpha1.PipelineRunSpec{
+				PipelineRef: pipelinev1alpha1.PipelineRef{Name: "build"},
+			},
+		},
+		Status: prowjobv1.ProwJobStatus{State: prowjobv1.TriggeredState},
+	}
+	// An embedding controller brings its own clients and informers, and starts the informers itself
+	pjc := prowjobfake.NewSimpleClientset(pj)
+	pji := prowjobinfo.NewSharedInformerFactory(pjc, 0).Prow().V1().ProwJobs()
+	pji.Informer().GetIndexer().Add(pj)
+	pc := pipelinefake.NewSimpleClientset()
+	pri := pipelineinfo.NewSharedInformerFactory(pc, 0).Tekton().V1alpha1().PipelineRuns()
+
+	opts, err := controller.NewPipelineOptions([]string{"--param-prefix=prow_"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	r, err := controller.NewReconciler(controller.Config{
+		ProwConfig: func() *config.Config {
+			return &config.Config{ProwConfig: config.ProwConfig{
+				ProwJobNamespace: "prowjobs",
+				Plank:            config.Plank{JobURLTemplate: jobURL},
+			}}
+		},
+		ProwJobClient:       pjc,
+		ProwJobInformer:     pji,
+		PipelineClient:      pc,
+		PipelineRunInformer: pri,
+		KubeClient:          kubefake.NewSimpleClientset(),
+		PipelineOptions:     opts,
+		TotURL:              tot.URL,
+		Requeue:             func(key string, delay time.Duration) {},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Keys are context/namespace/name, with the namespace the prowjob's pipeline runs in
+	if err := r.Reconcile(context.Background(), kube.DefaultClusterAlias+"/ci/nightly"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	runs, err := pc.TektonV1alpha1().PipelineRuns("ci").List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, p := range runs.Items {
+		fmt.Println(p.Name, p.Spec.PipelineRef.Name, p.Spec.Params[0].Name, p.Spec.Params[0].Value)
+	}
+	// Output: nightly build prow_build_id 1
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	exhaustedErrored      = "errored"
+	exhaustedUpdateFailed = "update_failed"
+)
+
+var (
+	// retriesExhausted counts keys the controller stopped retrying.
+	// A non-zero update_failed count means a prowjob was left in a non-final state.
+	retriesExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prow_pipeline_retries_exhausted_total",
+		Help: "Number of prowjobs the controller stopped retrying, by whether they were moved to error state.",
+	}, []string{"result"})
+
+	// pipelineStartLatency measures scheduling latency in each build cluster.
+	pipelineStartLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prow_pipeline_start_latency_seconds",
+		Help:    "Seconds from a prowjob starting to its pipeline run starting, by cluster context.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"context"})
+
+	// queueStalled flags workqueues whose depth keeps growing, which usually means the workers are wedged.
+	queueStalled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prow_pipeline_queue_stalled",
+		Help: "Whether a workqueue's depth has grown at every check within --stalled-queue-threshold, by queue.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(retriesExhausted)
+	prometheus.MustRegister(pipelineStartLatency)
+	prometheus.MustRegister(queueStalled)
+}
+
+// observeStartLatency records how long a prowjob waited for its pipeline run to start, when both have started.
+func observeStartLatency(context string, triggered metav1.Time, started *metav1.Time) {
+	if triggered.IsZero() || started.IsZero() {
+		return
+	}
+	latency := started.Sub(triggered.Time).Seconds()
+	if latency < 0 { // clock skew
+		latency = 0
+	}
+	pipelineStartLatency.WithLabelValues(context).Observe(latency)
+}
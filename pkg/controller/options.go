@@ -0,0 +1,743 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	prowjobv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowjobset "k8s.io/test-infra/prow/client/clientset/versioned"
+	prowjobinfo "k8s.io/test-infra/prow/client/informers/externalversions"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+	"k8s.io/test-infra/prow/logrusutil"
+	"k8s.io/test-infra/prow/pjutil"
+
+	pipelinev1alpha1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1alpha1"
+	pipelineset "github.com/tektoncd/pipeline/pkg/client/clientset/versioned"
+	pipelineinfo "github.com/tektoncd/pipeline/pkg/client/informers/externalversions"
+	pipelineinfov1alpha1 "github.com/tektoncd/pipeline/pkg/client/informers/externalversions/pipeline/v1alpha1"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubeinformers "k8s.io/client-go/informers"
+	coreinfov1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+)
+
+type options struct {
+	adminTokenFile  string
+	allContexts     bool
+	allowedNSes     string
+	apiTimeout      time.Duration
+	buildCluster    string
+	cancelOld       bool
+	config          string
+	defaultRevision string
+	dryRun          bool
+	extraLabels     string
+	fixDrift        bool
+	gcsAccounts     bool
+	generateNames   bool
+	githubHost      string
+	healthPort      int
+	jobTypes        string
+	keepRuns        bool
+	kubeconfig      string
+	maxCreates      int
+	maxDescription  int
+	maxRetries      int
+	maxRunBytes     int
+	namespaces      string
+	noResources     bool
+	orphanInterval  time.Duration
+	ownerLabel      string
+	paramPrefix     string
+	pauseFile       string
+	perContextQueue bool
+	reasonStates    string
+	preferSkipClone bool
+	prowBaseURL     string
+	requiredLabels  string
+	resyncPeriod    time.Duration
+	runURLTemplate  string
+	serviceAccounts string
+	specChecksum    bool
+	specConfigMaps  bool
+	stallThreshold  time.Duration
+	strictContexts  bool
+	stuckThreshold  time.Duration
+	summaryInterval time.Duration
+	tektonAnnots    string
+	totURL          string
+	totURLs         string
+	watchNSes       string
+}
+
+func parseOptions() options {
+	var o options
+	if err := o.parse(flag.CommandLine, os.Args[1:]); err != nil {
+		logrus.Fatalf("Invalid flags: %v", err)
+	}
+	return o
+}
+
+func (o *options) parse(flags *flag.FlagSet, args []string) error {
+	flags.StringVar(&o.adminTokenFile, "admin-token-file", "", "Path to a file holding a bearer token that authorizes POSTing a context/namespace/name key to /admin/reconcile on the health port to reconcile it immediately, and GETting the effective configuration from /debug/config. If empty, both endpoints are disabled.")
+	flags.BoolVar(&o.allContexts, "all-contexts", false, "Monitor all cluster contexts, not just default")
+	flags.StringVar(&o.allowedNSes, "allowed-job-namespaces", "", "Comma-separated namespaces prowjobs may pick for their pipelines with the prow.k8s.io/pipeline-namespace annotation. Prowjobs picking any other namespace move to error state. If empty, no prowjob may pick one.")
+	flags.DurationVar(&o.apiTimeout, "api-timeout", time.Minute, "How long a prowjob or pipeline API request may take before it fails and its key is retried, so a hung connection cannot block a worker forever. Watches are not limited. 0 disables the timeout.")
+	flags.StringVar(&o.totURL, "tot-url", "", "Tot URL")
+	flags.StringVar(&o.totURLs, "context-tot-urls", "", "Comma-separated context=url pairs vending a context's build IDs from its own tot instead of --tot-url")
+	flags.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to kubeconfig. Only required if out of cluster")
+	flags.StringVar(&o.config, "config", "", "Path to prow config.yaml")
+	flags.BoolVar(&o.cancelOld, "cancel-superseded-runs", false, "Cancel the unfinished pipeline runs of older builds of a presubmit for the same pull when a newer build starts, and abort their prowjobs")
+	flags.StringVar(&o.buildCluster, "build-cluster", "", "Path to file containing a YAML-marshalled kube.Cluster object. If empty, uses the local cluster.")
+	flags.BoolVar(&o.dryRun, "dry-run", false, "Log pipeline and prowjob mutations instead of sending them")
+	flags.StringVar(&o.extraLabels, "extra-labels", "", "Comma-separated key=value labels added to every pipeline run and resource, without replacing prow's own labels")
+	flags.BoolVar(&o.fixDrift, "fix-spec-drift", false, "Restore the generated spec of pipeline runs edited before they start")
+	flags.BoolVar(&o.generateNames, "generate-run-names", false, "Give each pipeline run a unique generated name prefixed by its prowjob's name, instead of the prowjob's name")
+	flags.BoolVar(&o.gcsAccounts, "gcs-service-accounts", false, "Run decorated jobs whose PipelineRunSpec and --default-service-accounts name no service account as a prow-gcs-<secret> service account, created if missing, that holds their GCS credentials secret")
+	flags.StringVar(&o.githubHost, "github-host", "github.com", "Host to clone from when a job's refs have an org and repo but no clone URI or repo link, such as a GitHub Enterprise host")
+	flags.IntVar(&o.healthPort, "health-port", 8081, "Port to serve /healthz, /readyz and /metrics on")
+	flags.StringVar(&o.jobTypes, "job-types", "", "Comma-separated prowjob types to manage, such as periodic,postsubmit. Prowjobs of other types are ignored. If empty, every type is managed.")
+	flags.BoolVar(&o.keepRuns, "keep-runs-on-agent-change", false, "Leave pipeline runs in place when their prowjob's agent changes away from jenkins-x, instead of deleting them")
+	flags.IntVar(&o.maxCreates, "max-concurrent-creates", 0, "Maximum number of PipelineRuns and PipelineResources created at once across all workers, to stay within the Tekton API server's capacity. 0 is unlimited.")
+	flags.IntVar(&o.maxDescription, "max-description-length", defaultDescriptionLength, "Maximum number of characters in the prowjob descriptions taken from pipeline run conditions, beyond which they are cut short with an ellipsis")
+	flags.IntVar(&o.maxRetries, "max-retries", 0, "Number of times to retry a failing reconcile before moving the prowjob to error state, backing off exponentially to 2m between retries, such as 16 to give up after about 5m. The default of 0 retries forever.")
+	flags.IntVar(&o.maxRunBytes, "max-pipeline-run-bytes", 0, "Move prowjobs whose generated PipelineRun serializes to more than this many bytes to error state, instead of failing at the API server. 0 disables the check.")
+	flags.StringVar(&o.namespaces, "pipeline-namespaces", "", "Comma-separated context=namespace pairs creating a context's pipelines in namespace instead of the prowjob's namespace")
+	flags.BoolVar(&o.noResources, "no-pipeline-resources", false, "Create no PipelineResources, passing the git url, revision and pulls to pipelines as git_url, git_revision and git_pulls params instead")
+	flags.DurationVar(&o.orphanInterval, "orphan-cleanup-interval", 0, "How often to delete finished prow pipeline runs whose prowjob no longer exists. 0 disables the cleanup.")
+	flags.StringVar(&o.ownerLabel, "owner-label", "", "Label key=value marking the pipeline runs this controller creates, and so may delete. If empty, "+kube.CreatedByProw+"=true is used. Give each Prow instance sharing a cluster its own label.")
+	flags.StringVar(&o.paramPrefix, "param-prefix", "", "Prefix for the names of params the controller adds to pipeline runs, such as prow_ to pass prow_build_id")
+	flags.StringVar(&o.pauseFile, "pause-file", "", "Path to a file whose existence pauses the controller: while it exists, no pipeline runs are created or deleted, but prowjob statuses are still updated from existing runs")
+	flags.BoolVar(&o.perContextQueue, "per-context-queues", false, "Give each cluster context its own rate-limited queue and workers, so a failing cluster does not delay the others")
+	flags.BoolVar(&o.preferSkipClone, "prefer-skip-cloning", false, "When a job sets both refs and decoration_config.skip_cloning, create no git resource instead of cloning the refs")
+	flags.StringVar(&o.prowBaseURL, "prow-base-url", "", "Base URL of the Prow instance, passed to pipelines as the prow_base_url param when set")
+	flags.StringVar(&o.reasonStates, "reason-states", "", "Comma-separated reason=state or reason=state:description pairs moving prowjobs whose finished pipeline run's Succeeded condition has that reason to state, one of success, failure, aborted or error, such as an infrastructure failure to error, instead of the state the condition's status maps to")
+	flags.StringVar(&o.requiredLabels, "required-labels", "", "Comma-separated label keys a prowjob must carry before a pipeline is created for it")
+	flags.DurationVar(&o.resyncPeriod, "resync-period", 0, "How often to requeue every jenkins-x prowjob in case an event was missed. 0 disables the resync.")
+	flags.StringVar(&o.serviceAccounts, "default-service-accounts", "", "Comma-separated context=serviceaccount pairs running a context's pipelines as serviceaccount when the job's PipelineRunSpec does not name one. Attach git credential secrets to the serviceaccount to clone private repos.")
+	flags.StringVar(&o.runURLTemplate, "run-url-template", "", "Go template for a link to each pipeline run's logs, rendered with the run's {{.Namespace}} and {{.Name}} and recorded on its prowjob")
+	flags.BoolVar(&o.specChecksum, "spec-checksum", false, "Record a checksum of each generated PipelineRun spec and warn when a run's spec drifts from it")
+	flags.BoolVar(&o.specConfigMaps, "spec-configmaps", false, "Watch ConfigMaps in the prowjob namespace, which needs RBAC to list and watch them there, so prowjobs may take their PipelineRunSpec YAML from one named as name/key by the prow.k8s.io/pipeline-spec-configmap annotation")
+	flags.StringVar(&o.tektonAnnots, "tekton-annotations", "", "Comma-separated key=value annotations added to every pipeline run to toggle Tekton features, such as experimental.tekton.dev/execution-mode=hermetic. Prowjobs may override them with their own tekton.dev annotations.")
+	flags.DurationVar(&o.stuckThreshold, "stuck-triggered-threshold", 0, "How long a jenkins-x prowjob may stay triggered without a pipeline run before it is requeued to create one. 0 disables the check.")
+	flags.DurationVar(&o.stallThreshold, "stalled-queue-threshold", 0, "How long a workqueue's depth may grow at every check before it is reported stalled, in the logs and the prow_pipeline_queue_stalled metric, as a sign of wedged workers. 0 disables the check.")
+	flags.DurationVar(&o.summaryInterval, "summary-interval", 0, "How often to log a per-context summary of prow pipeline runs. 0 disables the summary.")
+	flags.BoolVar(&o.strictContexts, "strict-contexts", false, "Move prowjobs targeting an unconfigured cluster context to error state instead of using the default context")
+	flags.StringVar(&o.watchNSes, "watch-namespaces", "", "Comma-separated context=namespace pairs limiting a context's pipeline run informer to namespace, for clusters where the controller may not watch every namespace. Prowjobs whose pipelines belong in another namespace move to error state.")
+	flags.StringVar(&o.defaultRevision, "default-revision", "", "Revision to check out when a job's refs name neither a base SHA nor a base ref. If empty, master is used.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("Parse flags: %v", err)
+	}
+	if o.kubeconfig != "" && o.buildCluster != "" {
+		return errors.New("deprecated --build-cluster may not be used with --kubeconfig")
+	}
+	if _, err := parseNamespaces(o.namespaces); err != nil {
+		return fmt.Errorf("--pipeline-namespaces: %v", err)
+	}
+	for _, ns := range splitList(o.allowedNSes) {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("--allowed-job-namespaces: invalid namespace %q: %s", ns, strings.Join(errs, "; "))
+		}
+	}
+	if err := validateWatchNamespaces(o.watchNSes, o.namespaces); err != nil {
+		return fmt.Errorf("--watch-namespaces: %v", err)
+	}
+	if _, err := parseContextValues(o.totURLs, "url"); err != nil {
+		return fmt.Errorf("--context-tot-urls: %v", err)
+	}
+	if _, err := parseServiceAccounts(o.serviceAccounts); err != nil {
+		return fmt.Errorf("--default-service-accounts: %v", err)
+	}
+	if _, err := parseRunURLTemplate(o.runURLTemplate); err != nil {
+		return fmt.Errorf("--run-url-template: %v", err)
+	}
+	if _, err := parseLabels(o.extraLabels); err != nil {
+		return fmt.Errorf("--extra-labels: %v", err)
+	}
+	if _, err := parseAnnotations(o.tektonAnnots); err != nil {
+		return fmt.Errorf("--tekton-annotations: %v", err)
+	}
+	if o.maxRunBytes < 0 {
+		return fmt.Errorf("--max-pipeline-run-bytes must not be negative: %d", o.maxRunBytes)
+	}
+	if o.stallThreshold < 0 {
+		return fmt.Errorf("--stalled-queue-threshold must not be negative: %s", o.stallThreshold)
+	}
+	if o.maxDescription <= 3 {
+		return fmt.Errorf("--max-description-length must leave room for more than an ellipsis: %d", o.maxDescription)
+	}
+	if o.apiTimeout < 0 {
+		return fmt.Errorf("--api-timeout must not be negative: %s", o.apiTimeout)
+	}
+	if o.maxCreates < 0 {
+		return fmt.Errorf("--max-concurrent-creates must not be negative: %d", o.maxCreates)
+	}
+	if _, _, err := parseOwnerLabel(o.ownerLabel); err != nil {
+		return fmt.Errorf("--owner-label: %v", err)
+	}
+	if _, err := parseJobTypes(o.jobTypes); err != nil {
+		return fmt.Errorf("--job-types: %v", err)
+	}
+	if _, err := parseReasonStates(o.reasonStates); err != nil {
+		return fmt.Errorf("--reason-states: %v", err)
+	}
+	if o.buildCluster != "" {
+		// TODO(fejta): change to warn and add a term date after plank migration
+		logrus.Infof("--build-custer is deprecated, please switch to --kubeconfig")
+	}
+	return nil
+}
+
+// stopper returns a channel that remains open until an interrupt is received.
+func stopper() chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		logrus.Warn("Interrupt received, attempting clean shutdown...")
+		close(stop)
+		<-c
+		logrus.Error("Second interrupt received, force exiting...")
+		os.Exit(1)
+	}()
+	return stop
+}
+
+// healthMux routes the liveness and readiness probes and metrics for the controller.
+func healthMux(c *controller) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", c.readyz)
+	if c.adminToken != "" {
+		mux.HandleFunc("/debug/config", c.debugConfig)
+		mux.HandleFunc("/admin/reconcile", c.adminReconcile)
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+type pipelineConfig struct {
+	client   pipelineset.Interface
+	kc       kubernetes.Interface
+	informer pipelineinfov1alpha1.PipelineRunInformer
+	opts     PipelineOptions
+	// totURL vends the context's build IDs, when set
+	totURL string
+}
+
+// PipelineOptions controls how pipeline objects are generated for a context.
+// The zero value generates runs the way the controller does without any flags.
+type PipelineOptions struct {
+	// defaultRevision is used when a job's refs do not resolve to a revision
+	defaultRevision string
+	// keepRunsOnAgentChange leaves runs alone when their prowjob moves to another agent
+	keepRunsOnAgentChange bool
+	// requiredLabels lists the label keys every prowjob must carry
+	requiredLabels []string
+	// prowBaseURL is passed to pipelines so they can link back to Prow
+	prowBaseURL string
+	// namespace overrides the prowjob's namespace for pipeline objects, when set
+	namespace string
+	// specChecksum records a checksum of each generated run spec to detect drift
+	specChecksum bool
+	// preferSkipCloning honors skip_cloning over refs when a job sets both
+	preferSkipCloning bool
+	// paramPrefix is prepended to the names of params the controller adds to runs
+	paramPrefix string
+	// runURLTemplate renders a link to a run's logs, when set
+	runURLTemplate *template.Template
+	// fixDrift restores the generated spec of runs edited before they start
+	fixDrift bool
+	// extraLabels are added to pipeline objects alongside prow's labels
+	extraLabels map[string]string
+	// githubHost is cloned from when refs only name an org and repo
+	githubHost string
+	// generateRunNames gives each run a unique name generated from its prowjob's name
+	generateRunNames bool
+	// tektonAnnotations toggle Tekton features on every run, unless the prowjob sets them itself
+	tektonAnnotations map[string]string
+	// paramsOnly passes git refs to pipelines as params instead of creating PipelineResources
+	paramsOnly bool
+	// serviceAccount runs pipelines whose spec does not name a service account, when set
+	serviceAccount string
+	// gcsServiceAccounts otherwise runs decorated pipelines as a service account holding their GCS credentials
+	gcsServiceAccounts bool
+	// jobTypes limits the prowjob types the controller manages, when set
+	jobTypes map[prowjobv1.ProwJobType]bool
+	// ownerKey and ownerValue label the runs this controller creates, when set
+	ownerKey   string
+	ownerValue string
+	// maxRunBytes rejects runs serializing to more bytes, when set
+	maxRunBytes int
+	// cancelSuperseded cancels the runs of older builds of a presubmit when a newer one starts
+	cancelSuperseded bool
+	// reasonStates overrides the state runs finishing for a reason map to, when set
+	reasonStates map[string]reasonState
+	// maxDescription limits the runes in descriptions taken from runs, when set
+	maxDescription int
+	// watchNamespace is the only namespace the context's runs are watched in, when set
+	watchNamespace string
+	// jobNamespaces lists the namespaces prowjobs may pick for their pipeline objects
+	jobNamespaces []string
+}
+
+// descriptionLength returns the most runes a description taken from a run may have.
+func (o PipelineOptions) descriptionLength() int {
+	if o.maxDescription > 0 {
+		return o.maxDescription
+	}
+	return defaultDescriptionLength
+}
+
+// watches returns true when runs in ns are visible to the context's informer.
+func (o PipelineOptions) watches(ns string) bool {
+	return o.watchNamespace == "" || o.watchNamespace == ns
+}
+
+// ownerLabel returns the label marking the pipeline runs this controller creates and may delete.
+func (o PipelineOptions) ownerLabel() (string, string) {
+	if o.ownerKey == "" {
+		return kube.CreatedByProw, "true"
+	}
+	return o.ownerKey, o.ownerValue
+}
+
+// ownerSelector selects the pipeline runs this controller created.
+func (o PipelineOptions) ownerSelector() labels.Selector {
+	key, value := o.ownerLabel()
+	return labels.SelectorFromSet(labels.Set{key: value})
+}
+
+// owns returns true when this controller created p.
+func (o PipelineOptions) owns(p pipelinev1alpha1.PipelineRun) bool {
+	key, value := o.ownerLabel()
+	v, ok := p.Labels[key]
+	return ok && v == value
+}
+
+// managesJobType returns true when prowjobs of type t should get pipelines.
+func (o PipelineOptions) managesJobType(t prowjobv1.ProwJobType) bool {
+	return o.jobTypes == nil || o.jobTypes[t]
+}
+
+// pipelineNamespace returns the namespace pipeline objects for a prowjob in ns belong in.
+func (o PipelineOptions) pipelineNamespace(ns string) string {
+	if o.namespace != "" {
+		return o.namespace
+	}
+	return ns
+}
+
+// pipelineOptions returns the pipeline options configured by flags for context.
+func (o *options) pipelineOptions(context string) PipelineOptions {
+	namespaces, _ := parseNamespaces(o.namespaces)                // validated by parse
+	runURLTemplate, _ := parseRunURLTemplate(o.runURLTemplate)    // validated by parse
+	extraLabels, _ := parseLabels(o.extraLabels)                  // validated by parse
+	serviceAccounts, _ := parseServiceAccounts(o.serviceAccounts) // validated by parse
+	tektonAnnotations, _ := parseAnnotations(o.tektonAnnots)      // validated by parse
+	jobTypes, _ := parseJobTypes(o.jobTypes)                      // validated by parse
+	ownerKey, ownerValue, _ := parseOwnerLabel(o.ownerLabel)      // validated by parse
+	watchNamespaces, _ := parseNamespaces(o.watchNSes)            // validated by parse
+	reasonStates, _ := parseReasonStates(o.reasonStates)          // validated by parse
+	return PipelineOptions{
+		defaultRevision:       o.defaultRevision,
+		keepRunsOnAgentChange: o.keepRuns,
+		requiredLabels:        splitList(o.requiredLabels),
+		prowBaseURL:           o.prowBaseURL,
+		namespace:             namespaces[context],
+		specChecksum:          o.specChecksum,
+		preferSkipCloning:     o.preferSkipClone,
+		paramPrefix:           o.paramPrefix,
+		runURLTemplate:        runURLTemplate,
+		fixDrift:              o.fixDrift,
+		extraLabels:           extraLabels,
+		githubHost:            o.githubHost,
+		serviceAccount:        serviceAccounts[context],
+		gcsServiceAccounts:    o.gcsAccounts,
+		generateRunNames:      o.generateNames,
+		tektonAnnotations:     tektonAnnotations,
+		paramsOnly:            o.noResources,
+		jobTypes:              jobTypes,
+		ownerKey:              ownerKey,
+		ownerValue:            ownerValue,
+		maxRunBytes:           o.maxRunBytes,
+		watchNamespace:        watchNamespaces[context],
+		maxDescription:        o.maxDescription,
+		reasonStates:          reasonStates,
+		cancelSuperseded:      o.cancelOld,
+		jobNamespaces:         splitList(o.allowedNSes),
+	}
+}
+
+// parseRunURLTemplate parses the run URL template, returning nil when it is empty.
+func parseRunURLTemplate(value string) (*template.Template, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return template.New("run-url").Option("missingkey=error").Parse(value)
+}
+
+// parseLabels converts comma-separated key=value pairs into a map of valid labels.
+func parseLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid key %q: %s", parts[0], strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(parts[1]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value %q: %s", parts[1], strings.Join(errs, "; "))
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// parseAnnotations converts comma-separated key=value pairs into a map of annotations with valid keys.
+func parseAnnotations(value string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid key %q: %s", parts[0], strings.Join(errs, "; "))
+		}
+		annotations[parts[0]] = parts[1]
+	}
+	return annotations, nil
+}
+
+// parseOwnerLabel converts a key=value pair into a valid label, returning an empty one when value is empty.
+func parseOwnerLabel(value string) (string, string, error) {
+	if value == "" {
+		return "", "", nil
+	}
+	l, err := parseLabels(value)
+	if err != nil {
+		return "", "", err
+	}
+	if len(l) != 1 {
+		return "", "", fmt.Errorf("%q is not a single key=value label", value)
+	}
+	for k, v := range l {
+		return k, v, nil
+	}
+	return "", "", nil
+}
+
+// parseJobTypes converts a comma-separated list of prowjob types into a set, returning nil when it is empty.
+func parseJobTypes(value string) (map[prowjobv1.ProwJobType]bool, error) {
+	types := splitList(value)
+	if len(types) == 0 {
+		return nil, nil
+	}
+	set := map[prowjobv1.ProwJobType]bool{}
+	for _, t := range types {
+		switch jt := prowjobv1.ProwJobType(t); jt {
+		case prowjobv1.PresubmitJob, prowjobv1.PostsubmitJob, prowjobv1.PeriodicJob, prowjobv1.BatchJob:
+			set[jt] = true
+		default:
+			return nil, fmt.Errorf("unknown prowjob type %q", t)
+		}
+	}
+	return set, nil
+}
+
+// parseReasonStates converts comma-separated reason=state[:description] pairs into a map.
+func parseReasonStates(value string) (map[string]reasonState, error) {
+	pairs := splitList(value)
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	reasons := map[string]reasonState{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not reason=state", pair)
+		}
+		if _, ok := reasons[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate reason %q", parts[0])
+		}
+		stateDesc := strings.SplitN(parts[1], ":", 2)
+		rs := reasonState{state: prowjobv1.ProwJobState(stateDesc[0])}
+		if len(stateDesc) == 2 {
+			rs.description = stateDesc[1]
+		}
+		switch rs.state {
+		case prowjobv1.SuccessState, prowjobv1.FailureState, prowjobv1.AbortedState, prowjobv1.ErrorState:
+		case prowjobv1.TriggeredState, prowjobv1.PendingState:
+			// The reason comes from a finished run, which must not leave its job unfinished
+			return nil, fmt.Errorf("reason %q must map to a final state, not %s", parts[0], rs.state)
+		default:
+			return nil, fmt.Errorf("unknown prowjob state %q for reason %q", stateDesc[0], parts[0])
+		}
+		reasons[parts[0]] = rs
+	}
+	return reasons, nil
+}
+
+// parseNamespaces converts comma-separated context=namespace pairs into a map.
+func parseNamespaces(value string) (map[string]string, error) {
+	return parseContextValues(value, "namespace")
+}
+
+// validateWatchNamespaces ensures each context with a watch namespace does not put its pipelines anywhere else.
+func validateWatchNamespaces(watch, pipeline string) error {
+	watchNamespaces, err := parseNamespaces(watch)
+	if err != nil {
+		return err
+	}
+	pipelineNamespaces, _ := parseNamespaces(pipeline) // validated by parse
+	for context, ns := range watchNamespaces {
+		if pns, ok := pipelineNamespaces[context]; ok && pns != ns {
+			return fmt.Errorf("context %s watches %s but creates pipelines in %s", context, ns, pns)
+		}
+	}
+	return nil
+}
+
+// parseServiceAccounts converts comma-separated context=serviceaccount pairs into a map.
+func parseServiceAccounts(value string) (map[string]string, error) {
+	return parseContextValues(value, "serviceaccount")
+}
+
+// parseContextValues converts comma-separated context=<kind> pairs into a map.
+func parseContextValues(value, kind string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range splitList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not context=%s", pair, kind)
+		}
+		if _, ok := values[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate context %q", parts[0])
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// withTimeout returns a copy of cfg whose requests fail after timeout, unless it is zero.
+// Informers must not use it, since it would also cut off their long-running watches.
+func withTimeout(cfg rest.Config, timeout time.Duration) *rest.Config {
+	cfg.Timeout = timeout
+	return &cfg
+}
+
+// newPipelineConfig returns a client and informer capable of mutating and monitoring the specified config.
+// The informer watches every namespace unless namespace is set, and client requests fail after timeout.
+func newPipelineConfig(cfg rest.Config, namespace string, timeout time.Duration, stop chan struct{}) (*pipelineConfig, error) {
+	bc, err := pipelineset.NewForConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := pipelineset.NewForConfig(withTimeout(cfg, timeout))
+	if err != nil {
+		return nil, err
+	}
+	kc, err := kubernetes.NewForConfig(withTimeout(cfg, timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure the pipeline CRD is deployed
+	// TODO(fejta): probably a better way to do this
+	if _, err := client.TektonV1alpha1().PipelineRuns(namespace).List(metav1.ListOptions{Limit: 1}); err != nil {
+		return nil, err
+	}
+
+	// Assume watches receive updates, but resync every 30m in case something wonky happens
+	bif := pipelineinfo.NewSharedInformerFactoryWithOptions(bc, 30*time.Minute, pipelineinfo.WithNamespace(namespace))
+	bif.Tekton().V1alpha1().PipelineRuns().Lister()
+	go bif.Start(stop)
+	return &pipelineConfig{
+		client:   client,
+		kc:       kc,
+		informer: bif.Tekton().V1alpha1().PipelineRuns(),
+	}, nil
+}
+
+// Main runs the controller configured by the command line flags and extra options until it receives a signal to stop.
+func Main(extra ...Option) {
+	logrusutil.ComponentInit("pipeline")
+
+	o := parseOptions()
+
+	pjutil.ServePProf()
+
+	configAgent := &config.Agent{}
+	if o.config != "" {
+		const ignoreJobConfig = ""
+		if err := configAgent.Start(o.config, ignoreJobConfig); err != nil {
+			logrus.WithError(err).Fatal("failed to load prow config")
+		}
+	}
+
+	configs, err := kube.LoadClusterConfigs(o.kubeconfig, o.buildCluster)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error building client configs")
+	}
+
+	local := configs[kube.InClusterContext]
+	if !o.allContexts {
+		logrus.Warn("Truncating to default context")
+		configs = map[string]rest.Config{
+			kube.DefaultClusterAlias: configs[kube.DefaultClusterAlias],
+		}
+	}
+
+	stop := stopper()
+
+	kc, err := kubernetes.NewForConfig(&local)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to create local kubernetes client")
+	}
+	pjc, err := prowjobset.NewForConfig(&local)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create prowjob client")
+	}
+	pjif := prowjobinfo.NewSharedInformerFactory(pjc, 30*time.Minute)
+	pjif.Prow().V1().ProwJobs().Lister()
+	go pjif.Start(stop)
+	var cmi coreinfov1.ConfigMapInformer
+	if cfg := configAgent.Config(); o.specConfigMaps && cfg != nil { // newController rejects a missing config
+		// Only the prowjob namespace holds the configmaps jobs take their pipeline specs from
+		kif := kubeinformers.NewSharedInformerFactoryWithOptions(kc, 30*time.Minute, kubeinformers.WithNamespace(cfg.ProwJobNamespace))
+		cmi = kif.Core().V1().ConfigMaps()
+		cmi.Lister()
+		go kif.Start(stop)
+	}
+	timedPJC, err := prowjobset.NewForConfig(withTimeout(local, o.apiTimeout))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create prowjob client")
+	}
+
+	var adminToken string
+	if o.adminTokenFile != "" {
+		b, err := ioutil.ReadFile(o.adminTokenFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to read admin token")
+		}
+		if adminToken = strings.TrimSpace(string(b)); adminToken == "" {
+			logrus.Fatalf("Empty admin token in %s", o.adminTokenFile)
+		}
+	}
+
+	totURLs, _ := parseContextValues(o.totURLs, "url") // validated by parse
+	watchNamespaces, _ := parseNamespaces(o.watchNSes) // validated by parse
+	pipelineConfigs := map[string]pipelineConfig{}
+	for context, cfg := range configs {
+		var bc *pipelineConfig
+		bc, err = newPipelineConfig(cfg, watchNamespaces[context], o.apiTimeout, stop)
+		if apierrors.IsNotFound(err) {
+			logrus.WithError(err).Warnf("Ignoring %s: knative pipeline CRD not deployed", context)
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).Fatalf("Failed to create %s pipeline client", context)
+		}
+		bc.opts = o.pipelineOptions(context)
+		bc.totURL = totURLs[context]
+		pipelineConfigs[context] = *bc
+	}
+
+	var contextQueues map[string]workqueue.RateLimitingInterface
+	if o.perContextQueue {
+		contextQueues = map[string]workqueue.RateLimitingInterface{}
+		for context := range pipelineConfigs {
+			contextQueues[context] = kube.RateLimiter(controllerName + "-" + context)
+		}
+	}
+
+	opts := controllerOptions{
+		kc:              kc,
+		pjc:             timedPJC,
+		pji:             pjif.Prow().V1().ProwJobs(),
+		cmi:             cmi,
+		pipelineConfigs: pipelineConfigs,
+		totURL:          o.totURL,
+		pauseFile:       o.pauseFile,
+		adminToken:      adminToken,
+		prowConfig:      configAgent.Config,
+		rl:              kube.RateLimiter(controllerName),
+		contextQueues:   contextQueues,
+		maxRetries:      o.maxRetries,
+		dryRun:          o.dryRun,
+		strictContexts:  o.strictContexts,
+		summaryInterval: o.summaryInterval,
+		resyncPeriod:    o.resyncPeriod,
+		orphanInterval:  o.orphanInterval,
+		stuckThreshold:  o.stuckThreshold,
+		stallThreshold:  o.stallThreshold,
+		maxCreates:      o.maxCreates,
+	}
+	controller, err := newController(opts)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error creating controller")
+	}
+	for _, option := range extra {
+		option(controller)
+	}
+
+	health := &http.Server{Addr: ":" + strconv.Itoa(o.healthPort), Handler: healthMux(controller)}
+	go func() {
+		logrus.WithError(health.ListenAndServe()).Warn("Health server exited")
+	}()
+
+	if err := controller.Run(2, stop); err != nil {
+		logrus.WithError(err).Fatal("Error running controller")
+	}
+	logrus.Info("Finished")
+}
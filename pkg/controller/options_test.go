@@ -0,0 +1,377 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	pipelinev1alpha1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1alpha1"
+	pipelineset "github.com/tektoncd/pipeline/pkg/client/clientset/versioned"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	prowjobv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/kube"
+)
+
+func TestOptions(t *testing.T) {
+	cases := []struct {
+		name     string
+		args     []string
+		expected *options
+		err      bool
+	}{{
+		name: "defaults work",
+		expected: &options{
+			githubHost:     "github.com",
+			healthPort:     8081,
+			maxDescription: 140,
+			apiTimeout:     time.Minute,
+		},
+	}, {
+		name: "error when providing both kubedonfig and build-cluter options ",
+		args: []string{"--all-contexts=true", "--tot-url=https://tot",
+			"--kubeconfig=/root/kubeconfig", "--config=/etc/config.yaml",
+			"--build-cluster=/etc/build-cluster.yaml"},
+		expected: &options{
+			allContexts:    true,
+			totURL:         "https://tot",
+			kubeconfig:     "/root/kubeconfig",
+			config:         "/etc/config.yaml",
+			buildCluster:   "/etc/build-cluster.yaml",
+			githubHost:     "github.com",
+			healthPort:     8081,
+			maxDescription: 140,
+			apiTimeout:     time.Minute,
+		},
+		err: true,
+	}, {
+		name: "parse all arguments",
+		args: []string{"--all-contexts=true", "--tot-url=https://tot",
+			"--kubeconfig=/root/kubeconfig", "--config=/etc/config.yaml",
+			"--default-revision=main", "--max-retries=3",
+			"--keep-runs-on-agent-change=true", "--required-labels=team,cost-center",
+			"--health-port=9090", "--dry-run=true",
+			"--prow-base-url=https://prow.example.com",
+			"--pipeline-namespaces=default=pipelines,build=ci",
+			"--strict-contexts=true", "--spec-checksum=true",
+			"--prefer-skip-cloning=true", "--summary-interval=5m",
+			"--param-prefix=prow_",
+			"--pause-file=/etc/pipeline/paused",
+			"--run-url-template=https://dashboard/#/namespaces/{{.Namespace}}/pipelineruns/{{.Name}}",
+			"--fix-spec-drift=true", "--resync-period=30m",
+			"--extra-labels=team=infra,cost-center=ci",
+			"--github-host=ghe.example.com", "--orphan-cleanup-interval=1h",
+			"--per-context-queues=true",
+			"--default-service-accounts=default=robot,build=builder",
+			"--generate-run-names=true",
+			"--tekton-annotations=experimental.tekton.dev/execution-mode=hermetic",
+			"--no-pipeline-resources=true",
+			"--job-types=periodic,postsubmit",
+			"--stuck-triggered-threshold=15m",
+			"--context-tot-urls=build=https://build-tot",
+			"--owner-label=prow.example.com/instance=internal",
+			"--max-concurrent-creates=20",
+			"--max-pipeline-run-bytes=1000000",
+			"--watch-namespaces=default=pipelines",
+			"--admin-token-file=/etc/admin/token",
+			"--stalled-queue-threshold=10m",
+			"--max-description-length=80",
+			"--api-timeout=30s",
+			"--gcs-service-accounts=true",
+			"--reason-states=PipelineRunTimeout=error:timed out,CouldntGetTask=error",
+			"--cancel-superseded-runs=true",
+			"--allowed-job-namespaces=ci,secrets",
+			"--spec-configmaps=true"},
+		expected: &options{
+			allContexts:     true,
+			totURL:          "https://tot",
+			kubeconfig:      "/root/kubeconfig",
+			config:          "/etc/config.yaml",
+			defaultRevision: "main",
+			maxRetries:      3,
+			keepRuns:        true,
+			requiredLabels:  "team,cost-center",
+			healthPort:      9090,
+			dryRun:          true,
+			prowBaseURL:     "https://prow.example.com",
+			namespaces:      "default=pipelines,build=ci",
+			strictContexts:  true,
+			specChecksum:    true,
+			preferSkipClone: true,
+			summaryInterval: 5 * time.Minute,
+			paramPrefix:     "prow_",
+			pauseFile:       "/etc/pipeline/paused",
+			runURLTemplate:  "https://dashboard/#/namespaces/{{.Namespace}}/pipelineruns/{{.Name}}",
+			fixDrift:        true,
+			resyncPeriod:    30 * time.Minute,
+			extraLabels:     "team=infra,cost-center=ci",
+			githubHost:      "ghe.example.com",
+			orphanInterval:  time.Hour,
+			perContextQueue: true,
+			serviceAccounts: "default=robot,build=builder",
+			generateNames:   true,
+			tektonAnnots:    "experimental.tekton.dev/execution-mode=hermetic",
+			noResources:     true,
+			jobTypes:        "periodic,postsubmit",
+			stuckThreshold:  15 * time.Minute,
+			totURLs:         "build=https://build-tot",
+			ownerLabel:      "prow.example.com/instance=internal",
+			maxCreates:      20,
+			maxRunBytes:     1000000,
+			watchNSes:       "default=pipelines",
+			adminTokenFile:  "/etc/admin/token",
+			stallThreshold:  10 * time.Minute,
+			maxDescription:  80,
+			apiTimeout:      30 * time.Second,
+			gcsAccounts:     true,
+			reasonStates:    "PipelineRunTimeout=error:timed out,CouldntGetTask=error",
+			cancelOld:       true,
+			allowedNSes:     "ci,secrets",
+			specConfigMaps:  true,
+		},
+	}, {
+		name: "reject invalid extra labels",
+		args: []string{"--extra-labels=team=not a valid value"},
+	}, {
+		name: "reject invalid tekton annotations",
+		args: []string{"--tekton-annotations=not a key=hermetic"},
+	}, {
+		name: "reject malformed run url template",
+		args: []string{"--run-url-template={{.Name"},
+	}, {
+		name: "reject malformed default service accounts",
+		args: []string{"--default-service-accounts=robot"},
+	}, {
+		name: "reject invalid allowed job namespaces",
+		args: []string{"--allowed-job-namespaces=ci,Not_A_Namespace"},
+	}, {
+		name: "reject malformed context tot urls",
+		args: []string{"--context-tot-urls=https://build-tot"},
+	}, {
+		name: "reject more than one owner label",
+		args: []string{"--owner-label=instance=internal,team=infra"},
+	}, {
+		name: "reject negative stalled queue thresholds",
+		args: []string{"--stalled-queue-threshold=-1m"},
+	}, {
+		name: "reject max description lengths too short for an ellipsis",
+		args: []string{"--max-description-length=3"},
+	}, {
+		name: "reject negative api timeouts",
+		args: []string{"--api-timeout=-1s"},
+	}, {
+		name: "reject negative max concurrent creates",
+		args: []string{"--max-concurrent-creates=-1"},
+	}, {
+		name: "reject negative max pipeline run bytes",
+		args: []string{"--max-pipeline-run-bytes=-1"},
+	}, {
+		name: "reject unknown reason states",
+		args: []string{"--reason-states=PipelineRunTimeout=flaky"},
+	}, {
+		name: "reject malformed reason states",
+		args: []string{"--reason-states=PipelineRunTimeout"},
+	}, {
+		name: "reject unknown job types",
+		args: []string{"--job-types=periodic,nightly"},
+	}, {
+		name: "reject malformed watch namespaces",
+		args: []string{"--watch-namespaces=pipelines"},
+	}, {
+		name: "reject creating pipelines outside the watch namespace",
+		args: []string{"--pipeline-namespaces=default=pipelines", "--watch-namespaces=default=ci"},
+	}, {
+		name: "reject malformed pipeline namespaces",
+		args: []string{"--pipeline-namespaces=default"},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			flags := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			var actual options
+			switch err := actual.parse(flags, tc.args); {
+			case tc.expected == nil:
+				if err == nil {
+					t.Error("failed to receive an error")
+				}
+			case err != nil:
+				if !tc.err {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case tc.err:
+				t.Error("failed to received expected error")
+			case !reflect.DeepEqual(&actual, tc.expected):
+				t.Errorf("actual %#v != expected %#v", actual, *tc.expected)
+			}
+		})
+	}
+}
+
+func TestPipelineOptionsNamespace(t *testing.T) {
+	o := options{namespaces: "default=pipelines,build=ci"}
+	cases := []struct {
+		name     string
+		context  string
+		expected string
+	}{
+		{
+			name:     "use the context override",
+			context:  "build",
+			expected: "ci",
+		},
+		{
+			name:    "no override for other contexts",
+			context: "other",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := o.pipelineOptions(tc.context)
+			if opts.namespace != tc.expected {
+				t.Errorf("namespace %q != expected %q", opts.namespace, tc.expected)
+			}
+			if actual := opts.pipelineNamespace("prowjob-ns"); tc.expected == "" && actual != "prowjob-ns" {
+				t.Errorf("pipeline namespace %q != expected prowjob-ns", actual)
+			}
+		})
+	}
+}
+
+func TestParseReasonStates(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		expected map[string]reasonState
+		err      bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "states with and without descriptions",
+			value: "NodeLost=error:infra failure: retry,PipelineRunTimeout=aborted",
+			expected: map[string]reasonState{
+				"NodeLost":           {state: prowjobv1.ErrorState, description: "infra failure: retry"},
+				"PipelineRunTimeout": {state: prowjobv1.AbortedState},
+			},
+		},
+		{
+			name:  "reject duplicate reasons",
+			value: "NodeLost=error,NodeLost=failure",
+			err:   true,
+		},
+		{
+			name:  "reject unknown states",
+			value: "NodeLost=retry",
+			err:   true,
+		},
+		{
+			name:  "reject states that are not final",
+			value: "NodeLost=pending",
+			err:   true,
+		},
+		{
+			name:  "reject missing reasons",
+			value: "=error",
+			err:   true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := parseReasonStates(tc.value)
+			switch {
+			case err != nil:
+				if !tc.err {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case tc.err:
+				t.Error("failed to receive an error")
+			case !reflect.DeepEqual(actual, tc.expected):
+				t.Errorf("%#v != expected %#v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{
+			name: "empty value has no items",
+		},
+		{
+			name:     "split on commas",
+			value:    "team,cost-center",
+			expected: []string{"team", "cost-center"},
+		},
+		{
+			name:     "drop blank items and surrounding space",
+			value:    " team, ,cost-center,",
+			expected: []string{"team", "cost-center"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := splitList(tc.value); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("actual %#v != expected %#v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release // never answer until the test is done
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	client, err := pipelineset.NewForConfig(withTimeout(rest.Config{Host: hung.URL}, 100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	c := &controller{
+		pipelines: map[string]pipelineConfig{kube.DefaultClusterAlias: {client: client}},
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.CreatePipelineRun(context.Background(), kube.DefaultClusterAlias, "ns", &pipelinev1alpha1.PipelineRun{
+			ObjectMeta: metav1.ObjectMeta{Name: "hung"},
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("created a pipeline run on a hung server")
+		}
+		if !transientError(err) {
+			t.Errorf("timeout %v is not transient, so the key would not be retried", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("create blocked on a hung server")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"time"
+
+	prowjobset "k8s.io/test-infra/prow/client/clientset/versioned"
+	prowjobinfov1 "k8s.io/test-infra/prow/client/informers/externalversions/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+
+	pipelineset "github.com/tektoncd/pipeline/pkg/client/clientset/versioned"
+	pipelineinfov1alpha1 "github.com/tektoncd/pipeline/pkg/client/informers/externalversions/pipeline/v1alpha1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Reconciler maps prowjobs to pipeline runs for another controller embedding that mapping,
+// such as one built on controller-runtime.
+type Reconciler interface {
+	// Reconcile ensures the prowjob for a context/namespace/name key has a pipeline run, updating the
+	// prowjob's status as the run progresses. The key's context is kube.DefaultClusterAlias.
+	// Once ctx is done, Reconcile stops waiting for a create slot or retrying conflicting updates.
+	// A returned error means the key should be retried.
+	Reconcile(ctx context.Context, key string) error
+}
+
+// Config holds the clients and informers NewReconciler builds a Reconciler from.
+// The caller starts the informers and waits for them to sync.
+type Config struct {
+	// ProwConfig must set prowjob_namespace, where prowjobs are read and updated
+	ProwConfig          config.Getter
+	ProwJobClient       prowjobset.Interface
+	ProwJobInformer     prowjobinfov1.ProwJobInformer
+	PipelineClient      pipelineset.Interface
+	PipelineRunInformer pipelineinfov1alpha1.PipelineRunInformer
+	// KubeClient records events and creates service accounts
+	KubeClient kubernetes.Interface
+	// PipelineOptions controls the pipeline runs generated, see NewPipelineOptions
+	PipelineOptions PipelineOptions
+	// TotURL vends build ids
+	TotURL string
+	// Requeue reconciles a key again after about delay, such as a job waiting for a concurrency slot.
+	// These keys are waiting rather than failing, so they should not add to the key's error backoff.
+	Requeue func(key string, delay time.Duration)
+}
+
+// NewReconciler returns a Reconciler that reads through cfg's informers and writes through its clients,
+// generating runs as the controller does for its default context.
+func NewReconciler(cfg Config, extra ...Option) (Reconciler, error) {
+	switch {
+	case cfg.ProwConfig == nil || cfg.ProwConfig() == nil:
+		return nil, errors.New("no prow config")
+	case cfg.ProwConfig().ProwJobNamespace == "":
+		return nil, errors.New("prow config does not set prowjob_namespace")
+	case cfg.ProwJobClient == nil || cfg.ProwJobInformer == nil:
+		return nil, errors.New("no prowjob client or informer")
+	case cfg.PipelineClient == nil || cfg.PipelineRunInformer == nil:
+		return nil, errors.New("no pipeline client or informer")
+	case cfg.KubeClient == nil:
+		return nil, errors.New("no kubernetes client")
+	case cfg.Requeue == nil:
+		return nil, errors.New("no requeue func")
+	}
+	recorder, err := newRecorder(cfg.KubeClient)
+	if err != nil {
+		return nil, err
+	}
+	c := &controller{
+		config:     cfg.ProwConfig,
+		pjc:        cfg.ProwJobClient,
+		pjLister:   cfg.ProwJobInformer.Lister(),
+		pjInformer: cfg.ProwJobInformer.Informer(),
+		recorder:   recorder,
+		totURL:     cfg.TotURL,
+		pipelines: map[string]pipelineConfig{
+			kube.DefaultClusterAlias: {
+				client:   cfg.PipelineClient,
+				kc:       cfg.KubeClient,
+				informer: cfg.PipelineRunInformer,
+				opts:     cfg.PipelineOptions,
+			},
+		},
+	}
+	for _, option := range extra {
+		option(c)
+	}
+	return embeddedReconciler{controller: c, requeue: cfg.Requeue}, nil
+}
+
+// embeddedReconciler is the controller without its workqueues, requeuing through the embedding controller instead.
+type embeddedReconciler struct {
+	*controller
+	requeue func(key string, delay time.Duration)
+}
+
+func (r embeddedReconciler) RequeueAfter(key string, delay time.Duration) {
+	r.requeue(key, delay)
+}
+
+func (r embeddedReconciler) Reconcile(ctx context.Context, key string) error {
+	return reconcile(ctx, r, key)
+}
+
+// NewPipelineOptions returns the PipelineOptions the controller's flags in args configure for its default context,
+// such as []string{"--param-prefix=prow_", "--no-pipeline-resources"}. Flags configuring the controller itself are ignored.
+func NewPipelineOptions(args []string) (PipelineOptions, error) {
+	var o options
+	flags := flag.NewFlagSet("pipeline", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := o.parse(flags, args); err != nil {
+		return PipelineOptions{}, err
+	}
+	return o.pipelineOptions(kube.DefaultClusterAlias), nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	prowjobv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowjobfake "k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	prowjobinfo "k8s.io/test-infra/prow/client/informers/externalversions"
+	"k8s.io/test-infra/prow/config"
+	"k8s.io/test-infra/prow/kube"
+
+	pipelinev1alpha1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1alpha1"
+	pipelinefake "github.com/tektoncd/pipeline/pkg/client/clientset/versioned/fake"
+	pipelineinfo "github.com/tektoncd/pipeline/pkg/client/informers/externalversions"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jenkins-x/prow-pipeline-controller/pkg/controller"
+)
+
+func TestWithPreCreateHook(t *testing.T) {
+	cases := []struct {
+		name          string
+		hook          controller.PreCreateHook
+		expectedRuns  int
+		expectedLabel string
+		expectedState prowjobv1.ProwJobState
+	}{
+		{
+			name: "hook adjusts the created run",
+			hook: func(pj *prowjobv1.ProwJob, p *pipelinev1alpha1.PipelineRun) error {
+				p.Labels["policy"] = pj.Spec.Job
+				return nil
+			},
+			expectedRuns:  1,
+			expectedLabel: "nightly",
+			expectedState: prowjobv1.TriggeredState, // until the run starts
+		},
+		{
+			name: "hook rejecting the run fails the job",
+			hook: func(*prowjobv1.ProwJob, *pipelinev1alpha1.PipelineRun) error {
+				return errors.New("not allowed")
+			},
+			expectedState: prowjobv1.ErrorState,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, "1")
+			}))
+			defer tot.Close()
+			jobURL := template.Must(template.New("JobURL").Parse(""))
+
+			pj := &prowjobv1.ProwJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "prowjobs"},
+				Spec: prowjobv1.ProwJobSpec{
+					Type:      prowjobv1.PeriodicJob,
+					Agent:     prowjobv1.ProwJobAgent("jenkins-x"),
+					Job:       "nightly",
+					Namespace: "ci",
+					PipelineRunSpec: &pipelinev1alpha1.PipelineRunSpec{
+						PipelineRef: pipelinev1alpha1.PipelineRef{Name: "build"},
+					},
+				},
+				Status: prowjobv1.ProwJobStatus{State: prowjobv1.TriggeredState},
+			}
+			pjc := prowjobfake.NewSimpleClientset(pj)
+			pji := prowjobinfo.NewSharedInformerFactory(pjc, 0).Prow().V1().ProwJobs()
+			if err := pji.Informer().GetIndexer().Add(pj); err != nil {
+				t.Fatalf("add prowjob: %v", err)
+			}
+			pc := pipelinefake.NewSimpleClientset()
+			r, err := controller.NewReconciler(controller.Config{
+				ProwConfig: func() *config.Config {
+					return &config.Config{ProwConfig: config.ProwConfig{
+						ProwJobNamespace: "prowjobs",
+						Plank:            config.Plank{JobURLTemplate: jobURL},
+					}}
+				},
+				ProwJobClient:       pjc,
+				ProwJobInformer:     pji,
+				PipelineClient:      pc,
+				PipelineRunInformer: pipelineinfo.NewSharedInformerFactory(pc, 0).Tekton().V1alpha1().PipelineRuns(),
+				KubeClient:          kubefake.NewSimpleClientset(),
+				TotURL:              tot.URL,
+				Requeue:             func(string, time.Duration) {},
+			}, controller.WithPreCreateHook(tc.hook))
+			if err != nil {
+				t.Fatalf("new reconciler: %v", err)
+			}
+
+			if err := r.Reconcile(context.Background(), kube.DefaultClusterAlias+"/ci/nightly"); err != nil {
+				t.Fatalf("reconcile: %v", err)
+			}
+			runs, err := pc.TektonV1alpha1().PipelineRuns("ci").List(metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("list runs: %v", err)
+			}
+			if len(runs.Items) != tc.expectedRuns {
+				t.Fatalf("%d runs != expected %d", len(runs.Items), tc.expectedRuns)
+			}
+			if tc.expectedRuns > 0 {
+				if actual := runs.Items[0].Labels["policy"]; actual != tc.expectedLabel {
+					t.Errorf("policy label %q != expected %q", actual, tc.expectedLabel)
+				}
+			}
+			updated, err := pjc.ProwV1().ProwJobs("prowjobs").Get("nightly", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("get prowjob: %v", err)
+			}
+			if updated.Status.State != tc.expectedState {
+				t.Errorf("state %q != expected %q", updated.Status.State, tc.expectedState)
+			}
+		})
+	}
+}